@@ -1,14 +1,17 @@
 package dupefilter
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/md5"
-	"errors"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
@@ -27,6 +30,20 @@ type RFPDupeFilter struct {
 	mu   sync.Mutex
 	boom boom.Filter
 	next antch.HttpMessageHandler
+	// seen is a file that keeps fingerprints of visited requests.
+	seen *os.File
+}
+
+// errDenied is the error of duplicate requests, it matches
+// antch.ErrDuplicate by errors.Is.
+type errDenied struct{}
+
+func (errDenied) Error() string {
+	return "RFPDupeFilter: request was denied"
+}
+
+func (errDenied) Is(err error) bool {
+	return err == antch.ErrDuplicate
 }
 
 func canonicalizeURL(u *url.URL) (n *url.URL) {
@@ -92,8 +109,9 @@ func fingerprint(req *http.Request, includeHeaders []string) []byte {
 }
 
 func (f *RFPDupeFilter) Send(req *http.Request) (*http.Response, error) {
-	// A request is specifies force to crawling.
-	if v, ok := req.Context().Value("dont_filter").(bool); ok && v {
+	// A request is specifies force to crawling, the "dont_filter"
+	// context key is kept for compatibility.
+	if v, ok := req.Context().Value("dont_filter").(bool); (ok && v) || antch.DontFilter(req) {
 		return f.next.Send(req)
 	}
 	fp := fingerprint(req, f.IncludeHeaders)
@@ -101,12 +119,55 @@ func (f *RFPDupeFilter) Send(req *http.Request) (*http.Response, error) {
 	if f.boom.TestAndAdd(fp) {
 		f.mu.Unlock()
 		// Is has visited before.
-		return nil, errors.New("RFPDupeFilter: request was denied")
+		return nil, errDenied{}
+	}
+	if f.seen != nil {
+		f.seen.WriteString(hex.EncodeToString(fp) + "\n")
 	}
 	f.mu.Unlock()
 	return f.next.Send(req)
 }
 
+// Resume loads fingerprints of visited requests from the file
+// requests.seen in dir, and appends new fingerprints to it.
+func (f *RFPDupeFilter) Resume(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "requests.seen"), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if fp, err := hex.DecodeString(scanner.Text()); err == nil {
+			f.boom.Add(fp)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return err
+	}
+	f.seen = file
+	return nil
+}
+
+// Close closes the file of fingerprints opened by Resume.
+func (f *RFPDupeFilter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.seen == nil {
+		return nil
+	}
+	err := f.seen.Close()
+	f.seen = nil
+	return err
+}
+
 func RFPDupeFilterMiddleware() antch.Middleware {
 	return func(next antch.HttpMessageHandler) antch.HttpMessageHandler {
 		bf := boom.NewDefaultScalableBloomFilter(0.01)
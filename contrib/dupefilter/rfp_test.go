@@ -3,14 +3,18 @@ package dupefilter
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/antchfx/antch"
 )
@@ -124,10 +128,100 @@ func TestRFPHandler(t *testing.T) {
 	if g, e := err.Error(), "RFPDupeFilter: request was denied"; g != e {
 		t.Fatalf("expected %s; but got %s", e, g)
 	}
+	if !errors.Is(err, antch.ErrDuplicate) {
+		t.Fatalf("expected %v is antch.ErrDuplicate", err)
+	}
+
+	resp, _ = handler.Send(req.WithContext(context.WithValue(req.Context(), "dont_filter", true)))
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected HTTP Status-Code is 200, but got %d", resp.StatusCode)
+	}
 
-	req = req.WithContext(context.WithValue(req.Context(), "dont_filter", true))
-	resp, _ = handler.Send(req)
+	resp, _ = handler.Send(antch.WithDontFilter(req))
 	if resp.StatusCode != 200 {
 		t.Fatalf("expected HTTP Status-Code is 200, but got %d", resp.StatusCode)
 	}
 }
+
+func TestRFPHandlerResume(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "antch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newHandler := func() antch.HttpMessageHandler {
+		handler := RFPDupeFilterMiddleware()(antch.HttpMessageHandlerFunc(func(req *http.Request) (*http.Response, error) {
+			return http.DefaultClient.Do(req)
+		}))
+		if err := handler.(antch.Resumable).Resume(dir); err != nil {
+			t.Fatalf("Resume failed: %v", err)
+		}
+		return handler
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/?q=go", nil)
+	h := newHandler()
+	if _, err := h.Send(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.(io.Closer).Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	// The visited request is restored from dir.
+	if _, err := newHandler().Send(req); err == nil {
+		t.Fatal("expected request was denied after resume, but got nil")
+	}
+}
+
+func TestCrawlerResumeInFlight(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "antch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The previous crawl crashed while the request is in flight, its
+	// fingerprint has been written by the dupe filter.
+	q, err := antch.NewDiskQueue(dir)
+	if err != nil {
+		t.Fatalf("NewDiskQueue failed: %v", err)
+	}
+	req, _ := http.NewRequest("GET", ts.URL+"/?q=go", nil)
+	q.Push(req)
+	req, _ = q.Pop()
+	q.Close()
+	h := RFPDupeFilterMiddleware()(antch.HttpMessageHandlerFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: http.NoBody, Request: req}, nil
+	}))
+	if err := h.(antch.Resumable).Resume(dir); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	h.Send(req)
+	h.(io.Closer).Close()
+
+	tc := antch.NewCrawler()
+	tc.JobDir = dir
+	tc.DownloadDelay = time.Millisecond
+	tc.UseMiddleware(RFPDupeFilterMiddleware())
+	tc.ErrorHandler = antch.ErrorHandlerFunc(func(_ chan<- antch.Item, _ *http.Request, err error) {
+		t.Errorf("expected no error; got %v", err)
+	})
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if g, e := atomic.LoadInt32(&hits), int32(1); g != e {
+		t.Errorf("expected %d requests; got %d", e, g)
+	}
+}
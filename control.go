@@ -0,0 +1,218 @@
+package antch
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+)
+
+// SpiderStatus is the status of a per-site spider of the Crawler.
+type SpiderStatus struct {
+	// Site is the host name of the website.
+	Site string `json:"site"`
+
+	// Scheme is the scheme of the URLs of the spider, such as "https".
+	Scheme string `json:"scheme"`
+
+	// Active is the number of requests being downloaded.
+	Active int `json:"active"`
+
+	// Queued is the number of requests that have been taken from the
+	// Scheduler and waiting for the spider to send, such as waiting
+	// for the download delay.
+	Queued int `json:"queued"`
+
+	// Paused reports whether the site is paused by PauseSite.
+	Paused bool `json:"paused"`
+}
+
+// Spiders returns the status of the live per-site spiders, sorted by
+// the site and scheme.
+func (c *Crawler) Spiders() []SpiderStatus {
+	paused := make(map[string]bool)
+	for _, host := range c.PausedSites() {
+		paused[host] = true
+	}
+	c.spiderMu.Lock()
+	a := make([]SpiderStatus, 0, len(c.spider))
+	for _, s := range c.spider {
+		s.mu.Lock()
+		a = append(a, SpiderStatus{
+			Site:   s.host,
+			Scheme: s.scheme,
+			Active: s.active,
+			Queued: s.queued,
+			Paused: paused[s.host],
+		})
+		s.mu.Unlock()
+	}
+	c.spiderMu.Unlock()
+	sort.Slice(a, func(i, j int) bool {
+		if a[i].Site != a[j].Site {
+			return a[i].Site < a[j].Site
+		}
+		return a[i].Scheme < a[j].Scheme
+	})
+	return a
+}
+
+// ControlHandler returns an http.Handler that controls the running
+// crawl, the endpoints are:
+//
+//	GET  /status    the status of the crawl
+//	POST /pause     pauses the crawl, or the sites of the form values "site", see Pause and PauseSite
+//	POST /resume    resumes the crawl, or the sites of the form values "site", see Resume and ResumeSite
+//	POST /enqueue   puts the URLs of the form values "url" into the Scheduler
+//	GET  /spiders   the status of the per-site spiders, see Spiders
+//	GET  /stats     the values of the StatsCollector, see Stats
+//	GET  /metrics   the metrics in the Prometheus format, see MetricsHandler
+//	POST /shutdown  shuts down the Crawler gracefully, see Shutdown
+//
+// The responses are JSON except the metrics. The handler has no
+// authentication, it should not be exposed to the public network.
+//
+// The handler can be mounted before the crawl is started, it never
+// starts the Crawler itself. Until then the /status, /spiders, /stats
+// and /metrics report nothing queued or sent, the pause and resume
+// take effect once the crawl is started, and /enqueue and /shutdown
+// respond 503 Service Unavailable.
+func (c *Crawler) ControlHandler() http.Handler {
+	return c.controlHandler()
+}
+
+func (c *Crawler) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.metricsHandler())
+	mux.HandleFunc("/status", controlFunc("GET", func(w http.ResponseWriter, r *http.Request) {
+		c.pendingMu.Lock()
+		pending := c.pending
+		c.pendingMu.Unlock()
+		closing, scheduled := false, 0
+		if c.started() {
+			select {
+			case <-c.closing:
+				closing = true
+			default:
+			}
+			scheduled = c.scheduler.Len()
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"started":      c.started(),
+			"paused":       c.Paused(),
+			"paused_sites": c.PausedSites(),
+			"closing":      closing,
+			"pending":      pending,
+			"scheduled":    scheduled,
+			"spiders":      len(c.Spiders()),
+		})
+	}))
+	mux.HandleFunc("/pause", controlFunc("POST", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("site") != "" {
+			for _, host := range r.Form["site"] {
+				c.PauseSite(host)
+			}
+			writeJSON(w, http.StatusOK, map[string][]string{"paused_sites": c.PausedSites()})
+			return
+		}
+		c.Pause()
+		writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+	}))
+	mux.HandleFunc("/resume", controlFunc("POST", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("site") != "" {
+			for _, host := range r.Form["site"] {
+				c.ResumeSite(host)
+			}
+			writeJSON(w, http.StatusOK, map[string][]string{"paused_sites": c.PausedSites()})
+			return
+		}
+		c.Resume()
+		writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+	}))
+	mux.HandleFunc("/enqueue", controlFunc("POST", c.startedFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		URLs := r.Form["url"]
+		if len(URLs) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "no url"})
+			return
+		}
+		n, errs := 0, map[string]string{}
+		for _, URL := range URLs {
+			if err := c.EnqueueURL(URL); err != nil {
+				errs[URL] = err.Error()
+				continue
+			}
+			n++
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"enqueued": n, "errors": errs})
+	})))
+	mux.HandleFunc("/spiders", controlFunc("GET", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.Spiders())
+	}))
+	mux.HandleFunc("/stats", controlFunc("GET", func(w http.ResponseWriter, r *http.Request) {
+		if !c.started() {
+			writeJSON(w, http.StatusOK, map[string]map[string]int64{})
+			return
+		}
+		writeJSON(w, http.StatusOK, c.Stats())
+	}))
+	mux.HandleFunc("/shutdown", controlFunc("POST", c.startedFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.close() {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": ErrCrawlerClosed.Error()})
+			return
+		}
+		go func() {
+			if err := c.shutdown(context.Background()); err != nil {
+				c.logf("crawler: shutdown got error: %v", err)
+			}
+		}()
+		writeJSON(w, http.StatusAccepted, map[string]bool{"closing": true})
+	})))
+	return mux
+}
+
+// controlFunc returns a handler that calls f if the method of request
+// is method.
+func controlFunc(method string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method && !(method == "GET" && r.Method == "HEAD") {
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		f(w, r)
+	}
+}
+
+// startedFunc returns a handler that calls f if the Crawler has been
+// started, the Crawler is not started by the handler.
+func (c *Crawler) startedFunc(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !c.started() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "crawler: not started"})
+			return
+		}
+		f(w, r)
+	}
+}
+
+// serveControl starts the control server on the ControlAddr.
+func (c *Crawler) serveControl() error {
+	ln, err := net.Listen("tcp", c.ControlAddr)
+	if err != nil {
+		return err
+	}
+	c.controlSrv = &http.Server{Handler: c.controlHandler()}
+	go c.controlSrv.Serve(ln)
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
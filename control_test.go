@@ -0,0 +1,198 @@
+package antch
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestControlHandler(t *testing.T) {
+	var n int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&n, 1)
+	}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	h := tc.ControlHandler()
+	// The middleware added after ControlHandler is used.
+	var sent int32
+	tc.UseMiddleware(func(next HttpMessageHandler) HttpMessageHandler {
+		return HttpMessageHandlerFunc(func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&sent, 1)
+			return next.Send(req)
+		})
+	})
+	do := func(method, path string, form url.Values, v interface{}) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if v != nil {
+			if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+				t.Fatalf("%s %s: %v", method, path, err)
+			}
+		}
+		return rec.Code
+	}
+
+	if code := do("GET", "/pause", nil, nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /pause expected %d; got %d", http.StatusMethodNotAllowed, code)
+	}
+	var paused struct {
+		PausedSites []string `json:"paused_sites"`
+	}
+	do("POST", "/pause", url.Values{"site": {"example.com", "example.org"}}, &paused)
+	do("POST", "/resume", url.Values{"site": {"example.com"}}, &paused)
+	if len(paused.PausedSites) != 1 || paused.PausedSites[0] != "example.org" {
+		t.Errorf("expected example.org paused; got %v", paused.PausedSites)
+	}
+	if code := do("POST", "/pause", nil, nil); code != http.StatusOK {
+		t.Fatalf("POST /pause expected %d; got %d", http.StatusOK, code)
+	}
+	var enqueued struct {
+		Enqueued int
+		Errors   map[string]string
+	}
+	form := url.Values{"url": {ts.URL + "/a", ts.URL + "/b", ":"}}
+	// The handler does not start the Crawler.
+	if code := do("POST", "/enqueue", form, nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("POST /enqueue before start expected %d; got %d", http.StatusServiceUnavailable, code)
+	}
+	if tc.started() {
+		t.Fatal("expected the Crawler is not started by the handler")
+	}
+	tc.StartURLs(nil)
+	if code := do("POST", "/enqueue", form, &enqueued); code != http.StatusOK {
+		t.Fatalf("POST /enqueue expected %d; got %d", http.StatusOK, code)
+	}
+	if enqueued.Enqueued != 2 || len(enqueued.Errors) != 1 {
+		t.Errorf("expected 2 enqueued and 1 error; got %+v", enqueued)
+	}
+	if code := do("POST", "/enqueue", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("POST /enqueue without url expected %d; got %d", http.StatusBadRequest, code)
+	}
+
+	// Nothing is crawled while the crawl is paused.
+	time.Sleep(50 * time.Millisecond)
+	if g := atomic.LoadInt32(&n); g != 0 {
+		t.Errorf("expected no requests while paused; got %d", g)
+	}
+	var status struct {
+		Paused  bool
+		Pending int
+	}
+	do("GET", "/status", nil, &status)
+	if !status.Paused || status.Pending != 2 {
+		t.Errorf("expected paused with 2 pending requests; got %+v", status)
+	}
+
+	do("POST", "/resume", nil, nil)
+	tc.Wait()
+	if g, e := atomic.LoadInt32(&n), int32(2); g != e {
+		t.Errorf("expected %d requests; got %d", e, g)
+	}
+	if g, e := atomic.LoadInt32(&sent), int32(2); g != e {
+		t.Errorf("expected %d requests sent by the middleware; got %d", e, g)
+	}
+	var spiders []SpiderStatus
+	do("GET", "/spiders", nil, &spiders)
+	if len(spiders) != 1 || spiders[0].Site != "127.0.0.1" || spiders[0].Scheme != "http" {
+		t.Errorf("expected the spider of 127.0.0.1; got %+v", spiders)
+	}
+	var stats map[string]map[string]int64
+	do("GET", "/stats", nil, &stats)
+	if g, e := stats[""]["requests/sent"], int64(2); g != e {
+		t.Errorf("requests/sent expected %d; got %d", e, g)
+	}
+
+	if code := do("POST", "/shutdown", nil, nil); code != http.StatusAccepted {
+		t.Errorf("POST /shutdown expected %d; got %d", http.StatusAccepted, code)
+	}
+	if code := do("POST", "/shutdown", nil, nil); code != http.StatusConflict {
+		t.Errorf("POST /shutdown again expected %d; got %d", http.StatusConflict, code)
+	}
+	if err := tc.EnqueueURL(ts.URL); err != ErrCrawlerClosed {
+		t.Errorf("expected %v; got %v", ErrCrawlerClosed, err)
+	}
+}
+
+func TestControlAddrListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tc := NewCrawler()
+	tc.ControlAddr = ln.Addr().String()
+	if err := tc.Run(context.Background()); err == nil {
+		t.Errorf("expected the error of listening on %s; got nil", tc.ControlAddr)
+	}
+}
+
+type closeHandler struct {
+	next   HttpMessageHandler
+	closed int32
+}
+
+func (h *closeHandler) Send(req *http.Request) (*http.Response, error) {
+	return h.next.Send(req)
+}
+
+func (h *closeHandler) Close() error {
+	time.Sleep(50 * time.Millisecond)
+	atomic.StoreInt32(&h.closed, 1)
+	return nil
+}
+
+func TestControlShutdownRun(t *testing.T) {
+	started := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	h := &closeHandler{}
+	tc.UseMiddleware(func(next HttpMessageHandler) HttpMessageHandler {
+		h.next = next
+		return h
+	})
+	tc.StartURLs([]string{ts.URL})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tc.Run(context.Background())
+	}()
+
+	<-started
+	rec := httptest.NewRecorder()
+	tc.ControlHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/shutdown", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST /shutdown expected %d; got %d", http.StatusAccepted, rec.Code)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Run expected no error; got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after shutdown")
+	}
+	if atomic.LoadInt32(&h.closed) != 1 {
+		t.Error("Run returned before the middlewares were closed")
+	}
+}
@@ -1,20 +1,57 @@
 package antch
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Item is represents an item object.
 type Item interface{}
 
+// ErrCrawlerClosed is returned by the Crawler's Crawl and Shutdown
+// methods after a call to Shutdown.
+var ErrCrawlerClosed = errors.New("crawler: closed")
+
+// ErrTimeout is the error of requests that did not complete within
+// the RequestTimeout. The error passed to ErrorHandler matches it by
+// errors.Is.
+var ErrTimeout = errors.New("crawler: request timeout")
+
+// timeoutError wraps the error of a request that timed out.
+type timeoutError struct {
+	err error
+}
+
+func (e *timeoutError) Error() string {
+	return ErrTimeout.Error() + ": " + e.err.Error()
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.err
+}
+
+func (e *timeoutError) Is(err error) bool {
+	return err == ErrTimeout
+}
+
+// Timeout and Temporary implement the net.Error interface.
+func (e *timeoutError) Timeout() bool {
+	return true
+}
+
+func (e *timeoutError) Temporary() bool {
+	return true
+}
+
 // Crawler is core of web crawl server that provides crawl websites
 // and calls pipeline to process for received data from their pages.
 type Crawler struct {
@@ -32,6 +69,7 @@ type Crawler struct {
 	MaxConcurrentRequestsPerSite int
 
 	// RequestTimeout specifies a time to wait before the HTTP Request times out.
+	// The retries and redirects of the request have their own timeout.
 	// Default is 30s.
 	RequestTimeout time.Duration
 
@@ -39,11 +77,60 @@ type Crawler struct {
 	// Default is 0.25s.
 	DownloadDelay time.Duration
 
+	// RobotstxtMaxDelay specifies the maximum download delay that adopted
+	// from the Crawl-delay or Request-rate of robots.txt, if the robots.txt
+	// middleware is used.
+	// Default is 60s.
+	RobotstxtMaxDelay time.Duration
+
+	// Sites specifies the settings for the websites that override the
+	// settings of Crawler, such as MaxConcurrentRequestsPerSite. The key
+	// is a host name such as "example.com", or a wildcard such as
+	// "*.example.com" that matches the domain and all its subdomains.
+	Sites map[string]SiteSettings
+
+	// AutoThrottle enables adjusts the download delay and concurrency
+	// of each website automatically, based on the latency and errors
+	// of the responses. The DownloadDelay is the minimum delay and the
+	// MaxConcurrentRequestsPerSite is the maximum concurrency.
+	AutoThrottle bool
+
+	// AutoThrottleMaxDelay specifies the maximum download delay of
+	// AutoThrottle when the website is slow or got errors.
+	// Default is 60s.
+	AutoThrottleMaxDelay time.Duration
+
+	// AutoThrottleTargetConcurrency specifies the average number of
+	// requests that AutoThrottle should be sending in parallel to
+	// each website.
+	// Default is 1.0.
+	AutoThrottleTargetConcurrency float64
+
 	// MaxConcurrentItems specifies the maximum number of concurrent items
 	// to process parallel in the pipeline.
 	// Default is 32.
 	MaxConcurrentItems int
 
+	// AllowedDomains specifies the domains that allowed to crawl, the
+	// requests to other websites are dropped, includes the redirects.
+	// A domain such as "example.com" allows example.com and all its
+	// subdomains.
+	// If empty, all domains are allowed.
+	AllowedDomains []string
+
+	// MaxDepth specifies the maximum depth of requests to crawl, the
+	// follow-up requests deeper than it are dropped. See Depth.
+	// If zero, there is no limit.
+	MaxDepth int
+
+	// DepthPriority specifies how the priority of follow-up requests
+	// is adjusted by their depth, the priority is decreased by the depth
+	// multiplied by DepthPriority. A positive value crawls shallower
+	// requests first (breadth-first order), and a negative value
+	// crawls deeper requests first (depth-first order).
+	// Default is 0, the priority is not adjusted.
+	DepthPriority int
+
 	// UserAgent specifies the user-agent for the remote server.
 	UserAgent string
 
@@ -53,24 +140,111 @@ type Crawler struct {
 	// standard logger.
 	ErrorLog Logger
 
+	// ErrorHandler specifies an optional handler for the HTTP requests
+	// that failed, the ErrorHandler attached to the request by
+	// WithErrorHandler takes precedence.
+	// If nil, the errors are logged.
+	ErrorHandler ErrorHandler
+
+	// NotModifiedHandler specifies an optional handler for the 304 Not
+	// Modified responses of the conditional requests that sent by the
+	// IncrementalMiddleware, it takes precedence over the Handlers
+	// registered and attached to the request.
+	// If nil, the responses are skipped.
+	NotModifiedHandler Handler
+
+	// StatsCollector specifies the Stats that collects the values of
+	// the crawl, the global values are logged when the Crawler is shut
+	// down. See Crawler.Stats.
+	// If nil, the values are kept in memory.
+	StatsCollector Stats
+
+	// Scheduler specifies the queue of HTTP requests that waiting
+	// to be crawled.
+	// If nil, the in-memory priority queue is used.
+	Scheduler Scheduler
+
+	// MaxQueuedRequests specifies the maximum number of requests in
+	// the Scheduler, the Handlers are blocked on writing follow-up
+	// requests while the Scheduler is full, until the requests are
+	// taken out to crawl or the Crawler is shutting down.
+	// Default is 0, no limit.
+	MaxQueuedRequests int
+
+	// JobDir specifies a directory to keep the crawl state, includes
+	// the pending requests and the state of Resumable middlewares,
+	// the crawl will be resumed from the state if the directory is
+	// used again.
+	// If empty, the crawl state is not persisted.
+	JobDir string
+
+	// ControlAddr optionally specifies the TCP address for the control
+	// server to listen on, such as "127.0.0.1:6023". The control server
+	// serves the ControlHandler of the Crawler, it is closed when the
+	// Crawler is shut down. The error of listening is returned by Run
+	// and Crawl.
+	// If empty, the control server is not started.
+	ControlAddr string
+
 	// Exit is an optional channel whose closure indicates that the Crawler
 	// instance should be stop work and exit.
+	// Use Run with a Context or Shutdown to stop the Crawler gracefully.
 	Exit <-chan struct{}
 
-	readCh  chan *http.Request
-	writeCh chan Item
-
-	client      *http.Client
-	pipeHandler PipelineHandler
-	mids        []Middleware
-	pipes       []Pipeline
+	scheduler Scheduler
+	stats     Stats
+	metrics   metrics
+	writeCh   chan Item
+
+	client       *http.Client
+	pipeHandler  PipelineHandler
+	pipeHandlers []PipelineHandler
+	msgHandlers  []HttpMessageHandler
+	mids         []Middleware
+	pipes        []Pipeline
+	offsite      *OffsiteFilter
+	controlSrv   *http.Server
+	initErr      error
+	// inited is set to 1 when the Crawler has been initialized.
+	inited int32
 
 	spider   map[string]*spider
 	spiderMu sync.Mutex
 
-	once sync.Once
-	mu   sync.RWMutex
-	m    map[string]muxEntry
+	// resumeCh is not nil while the crawl is paused, it is closed
+	// when the crawl is resumed. The pausedSites are the same for
+	// each paused site, and held are the requests of the paused
+	// sites that have been taken from the Scheduler.
+	resumeCh    chan struct{}
+	pausedSites map[string]chan struct{}
+	held        map[string][]*http.Request
+	pauseMu     sync.Mutex
+
+	// pending is the number of requests and items that
+	// has not been finished.
+	pending   int
+	pendingMu sync.Mutex
+	pendingCh chan struct{}
+
+	// poppedCh is closed when a request is taken from the Scheduler.
+	poppedCh chan struct{}
+	popMu    sync.Mutex
+
+	// closing is closed when Shutdown is called, and ctx is cancelled
+	// when all loops and in-flight requests should be stop work.
+	// closed is closed when the shutdown is finished.
+	closing     chan struct{}
+	closingOnce sync.Once
+	closed      chan struct{}
+	ctx         context.Context
+	cancel      context.CancelFunc
+	quit        <-chan struct{}
+	quitOnce    sync.Once
+	closeErr    error
+
+	once   sync.Once
+	mu     sync.RWMutex
+	routes []*route
 }
 
 // NewCrawler returns a new Crawler with default settings.
@@ -81,13 +255,11 @@ func NewCrawler() *Crawler {
 	}
 }
 
-type muxEntry struct {
-	pattern string
-	h       Handler
-}
-
 // StartURLs starts crawling for the given URL list.
+// The pending requests in the JobDir are restored and
+// crawled even if the URL list is empty.
 func (c *Crawler) StartURLs(URLs []string) {
+	c.once.Do(c.init)
 	for _, URL := range URLs {
 		c.EnqueueURL(URL)
 	}
@@ -98,11 +270,27 @@ func (c *Crawler) Crawl(req *http.Request) error {
 	if req == nil {
 		return errors.New("req is nil")
 	}
-	return c.enqueue(req, 5*time.Second)
+	c.once.Do(c.init)
+	if c.initErr != nil {
+		return c.initErr
+	}
+	select {
+	case <-c.closing:
+		return ErrCrawlerClosed
+	default:
+	}
+	return c.schedule(req)
 }
 
 // EnqueueURL puts given URL into the backup URLs queue.
 func (c *Crawler) EnqueueURL(URL string) error {
+	return c.EnqueueURLWithHandler(URL, nil)
+}
+
+// EnqueueURLWithHandler puts given URL into the backup URLs queue,
+// its response is served by h instead of the Handler registered for
+// the URL. If h is nil, the registered Handler is used.
+func (c *Crawler) EnqueueURLWithHandler(URL string, h Handler) error {
 	if URL == "" {
 		return errors.New("URL is nil")
 	}
@@ -110,41 +298,262 @@ func (c *Crawler) EnqueueURL(URL string) error {
 	if err != nil {
 		return err
 	}
+	if h != nil {
+		req = WithHandler(req, h)
+	}
 	return c.Crawl(req)
 }
 
-func (c *Crawler) enqueue(req *http.Request, timeout time.Duration) error {
+// Wait blocks until the crawl is finished, that is no requests are
+// queued or in flight, no Handlers are running and the pipeline has
+// processed all items, or until the Crawler is stopped.
+func (c *Crawler) Wait() {
 	c.once.Do(c.init)
+	c.waitPending(func(n int) bool { return n == 0 }, nil)
+}
+
+// Run starts the crawler and blocks until the crawl is finished or ctx
+// is done. If ctx is done, all outstanding HTTP requests are cancelled
+// and the per-site spiders are stopped immediately.
+//
+// Run closes the crawler like Shutdown before it returns, and returns
+// ctx's error if ctx is done before the crawl finished. If the crawler
+// is shut down by others, such as Shutdown or the control server, Run
+// waits for the shutdown to finish and returns nil.
+func (c *Crawler) Run(ctx context.Context) error {
+	c.once.Do(c.init)
+	if c.initErr != nil {
+		return c.initErr
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Wait()
+	}()
 	select {
-	case c.readCh <- req:
-	case <-time.After(timeout):
-		return errors.New("crawler: timeout, worker is busy")
+	case <-done:
+		if c.close() {
+			return c.shutdown(ctx)
+		}
+		select {
+		case <-c.closed:
+			return nil
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	}
+	if c.close() {
+		c.shutdown(ctx)
+	} else {
+		c.stop()
+		<-c.closed
+	}
+	return ctx.Err()
+}
+
+// Shutdown gracefully shuts down the crawler. Shutdown stops accepting
+// new requests, waits for the in-flight requests, the running Handlers
+// and the items in the pipeline to finish, and then closes the
+// Scheduler and the middlewares and pipelines that implement io.Closer.
+// The requests in the Scheduler that not started yet are left, they
+// will be restored next time if the JobDir is set.
+//
+// If the provided context expires before the shutdown is complete,
+// Shutdown cancels the in-flight requests, stops all work immediately
+// and returns the context's error.
+func (c *Crawler) Shutdown(ctx context.Context) error {
+	c.once.Do(c.init)
+	if !c.close() {
+		return ErrCrawlerClosed
+	}
+	return c.shutdown(ctx)
+}
+
+// started reports whether the Crawler has been initialized, it does
+// not initialize the Crawler.
+func (c *Crawler) started() bool {
+	return atomic.LoadInt32(&c.inited) == 1
+}
+
+// close stops accepting new requests, it returns false if the Crawler
+// has been closed.
+func (c *Crawler) close() bool {
+	closed := false
+	c.closingOnce.Do(func() {
+		close(c.closing)
+		c.releaseHeld("")
+		closed = true
+	})
+	return closed
+}
+
+// shutdown waits for the pending requests and items to finish and
+// closes the Crawler, after close is called.
+func (c *Crawler) shutdown(ctx context.Context) error {
+	ok := c.waitPending(func(n int) bool { return n <= c.scheduler.Len() }, ctx.Done())
+	c.stop()
+	c.dumpStats()
+	err := c.closeErr
+	for _, h := range c.msgHandlers {
+		if v, ok := h.(io.Closer); ok {
+			if err2 := v.Close(); err == nil {
+				err = err2
+			}
+		}
+	}
+	for _, h := range c.pipeHandlers {
+		if v, ok := h.(io.Closer); ok {
+			if err2 := v.Close(); err == nil {
+				err = err2
+			}
+		}
+	}
+	if !ok {
+		err = ctx.Err()
+	}
+	close(c.closed)
+	return err
+}
+
+// stop makes all loops stop work, cancels all in-flight requests
+// and closes the Scheduler and the control server.
+func (c *Crawler) stop() {
+	c.quitOnce.Do(func() {
+		c.cancel()
+		c.releaseHeld("")
+		c.closeErr = c.scheduler.Close()
+		if c.controlSrv != nil {
+			c.controlSrv.Close()
+		}
+	})
+}
+
+// waitPending blocks until f returns true for the number of
+// pending requests and items. It returns false if the Crawler
+// was stopped or the cancel is closed.
+func (c *Crawler) waitPending(f func(int) bool, cancel <-chan struct{}) bool {
+	for {
+		c.pendingMu.Lock()
+		if f(c.pending) {
+			c.pendingMu.Unlock()
+			return true
+		}
+		if c.pendingCh == nil {
+			c.pendingCh = make(chan struct{})
+		}
+		ch := c.pendingCh
+		c.pendingMu.Unlock()
+
+		select {
+		case <-ch:
+		case <-c.quit:
+			return false
+		case <-cancel:
+			return false
+		}
+	}
+}
+
+// addPending adds delta to the number of pending requests and items.
+func (c *Crawler) addPending(delta int) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	c.pending += delta
+	if c.pendingCh != nil {
+		close(c.pendingCh)
+		c.pendingCh = nil
+	}
+}
+
+// schedule puts an HTTP request into the Scheduler.
+func (c *Crawler) schedule(req *http.Request) error {
+	if !c.offsite.Allow(req.URL) {
+		c.incStat(req, "requests/filtered/offsite", 1)
+		return ErrOffsite
+	}
+	c.incStat(req, "requests/scheduled", 1)
+	c.incStat(req, fmt.Sprintf("requests/depth/%d", Depth(req)), 1)
+	c.addPending(1)
+	if err := c.scheduler.Push(req); err != nil {
+		c.addPending(-1)
+		return err
 	}
 	return nil
 }
 
-// Handle registers the Handler for the given pattern.
+// ack tells the Scheduler the request popped from it is finished. The
+// requests are not acked after the crawler stopped, they may have been
+// cancelled and will be crawled again after restart.
+func (c *Crawler) ack(req *http.Request) {
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+	if a, ok := c.scheduler.(Acker); ok {
+		if err := a.Ack(req); err != nil {
+			c.logf("crawler: ack request got error: %v", err)
+		}
+	}
+}
+
+// Handle registers the Handler for the given pattern. The pattern
+// matches the URL of the request of responses, its syntax is:
+//
+//	[scheme://]host[/path]
+//
+// The host is a host name such as "example.com" that matches the
+// host with any port, "example.com:8080" that matches the port too,
+// or "*.example.com" that matches example.com and all its subdomains.
+// The host can be omitted such as "/search" to match all hosts.
+//
+// The path matches the path of URL by segments, such as "/item" matches
+// "/item" and "/item/1", but not "/item-archive". A segment can be:
+//
+//	{name}     matches a segment and captures it as a parameter
+//	{name...}  matches the remaining path and captures it, the last segment only
+//	*.html     a glob pattern that matches a segment, see path.Match
+//	**         matches any number of segments
+//
+// A path ends with "{$}" matches the whole path only, such as
+// "example.com/{$}" matches the home page only.
+//
+// A pattern starts with "~" is a regular expression that matches the
+// whole URL, such as `~^https://example\.com/item/(?P<id>\d+)$`, its
+// named groups are captured as parameters.
+//
 // If pattern is "*" means will matches all requests if
-// no any pattern matches.
+// no any pattern matches. The registered Handlers are used
+// only for the requests that no Handler attached by WithHandler.
+//
+// If many patterns match, the more specific one is used: the "{$}"
+// pattern, the pattern with more literal segments, more segments,
+// fewer glob segments, an exact host, a wildcard host, then the path
+// patterns take precedence over the regular expressions, a scheme,
+// more constraints of the Route in order, at last the pattern
+// registered earlier. A regular expression starts with "^" is ranked
+// by the literal prefix of it, such as `~^https://example\.com/item/`
+// is ranked as "https://example.com/item".
+//
+// The captured parameters are available by RouteParams of the
+// request of response.
 func (c *Crawler) Handle(pattern string, handler Handler) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
 	if pattern == "" {
 		panic("crawler: invalid domain")
 	}
-	if handler == nil {
-		panic("crawler: handler is nil")
-	}
-	if c.m == nil {
-		c.m = make(map[string]muxEntry)
-	}
-	c.m[pattern] = muxEntry{pattern: pattern, h: handler}
+	c.HandleRoute(Route{Pattern: pattern, Handler: handler})
 }
 
 // Handler returns a Handler for the give HTTP Response.
+// The Handler attached to the request by WithHandler takes
+// precedence over the registered patterns, and the
+// NotModifiedHandler takes precedence over both for the
+// responses that NotModified reports.
 func (c *Crawler) Handler(res *http.Response) (h Handler, pattern string) {
-	return c.handler(res.Request.Host, res.Request.URL.Path)
+	h, pattern, _ = c.route(res)
+	return
 }
 
 // UseMiddleware adds a Middleware to the crawler.
@@ -180,6 +589,19 @@ func (c *Crawler) UseRobotstxt() *Crawler {
 	return c.UseMiddleware(RobotstxtMiddleware())
 }
 
+// UseRetry enables retry the failed HTTP requests with default
+// RetryPolicy, it should be called after other middlewares added.
+func (c *Crawler) UseRetry() *Crawler {
+	return c.UseMiddleware(RetryMiddleware(RetryPolicy{}))
+}
+
+// UseHttpCache enables cache the HTTP responses in dir, the cached
+// responses are always used, see HttpCacheMiddleware for other
+// policies.
+func (c *Crawler) UseHttpCache(dir string) *Crawler {
+	return c.UseMiddleware(HttpCacheMiddleware(HttpCacheSettings{Dir: dir}))
+}
+
 func (c *Crawler) logf(format string, args ...interface{}) {
 	if c.ErrorLog != nil {
 		c.ErrorLog.Output(2, fmt.Sprintf(format, args...))
@@ -191,18 +613,48 @@ func (c *Crawler) logf(format string, args ...interface{}) {
 func (c *Crawler) transport() http.RoundTripper {
 	ts := &http.Transport{
 		MaxIdleConns:          1000,
-		MaxIdleConnsPerHost:   c.maxConcurrentRequestsPerSite() * 2,
+		MaxIdleConnsPerHost:   c.maxIdleConnsPerHost(),
 		IdleConnTimeout:       120 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 		DialContext:           proxyDialContext,
 	}
 
+	send := func(req *http.Request) (*http.Response, error) {
+		// Each attempt of the request has its own timeout, such as
+		// the retries and redirects.
+		d, _ := req.Context().Value(timeoutKey{}).(time.Duration)
+		if d <= 0 {
+			return ts.RoundTrip(req)
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), d)
+		resp, err := ts.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
 	var stack HttpMessageHandler = HttpMessageHandlerFunc(func(req *http.Request) (*http.Response, error) {
-		return ts.RoundTrip(req)
+		// The request served from the cache is sent without a slot,
+		// it is taken if the request is downloaded anyway.
+		sl, _ := req.Context().Value(slotKey{}).(*slot)
+		if sl != nil && !sl.acquire(req.Context().Done()) {
+			return nil, req.Context().Err()
+		}
+		// The latency is measured for each attempt, the time waiting
+		// to retry or redirect the request is not counted.
+		start := time.Now()
+		resp, err := send(req)
+		if sl != nil {
+			sl.s.observe(req.URL, time.Now().Sub(start), resp, err)
+		}
+		return resp, err
 	})
 	for i := len(c.mids) - 1; i >= 0; i-- {
 		stack = c.mids[i](stack)
+		c.msgHandlers = append(c.msgHandlers, stack)
 	}
 
 	return roundTripperFunc(stack.Send)
@@ -212,6 +664,7 @@ func (c *Crawler) pipeline() PipelineHandler {
 	var stack PipelineHandler = PipelineHandlerFunc(func(item Item) {})
 	for i := len(c.pipes) - 1; i >= 0; i-- {
 		stack = c.pipes[i](stack)
+		c.pipeHandlers = append(c.pipeHandlers, stack)
 	}
 	return stack
 }
@@ -222,46 +675,6 @@ func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
 	return f(req)
 }
 
-func (c *Crawler) pathMatch(pattern, path string) bool {
-	n := len(pattern)
-	if pattern[n-1] == '/' {
-		pattern = pattern[:n-1]
-	}
-	return strings.Index(path, pattern) >= 0
-}
-
-func (c *Crawler) matchHandler(path string) (h Handler, pattern string) {
-	var n = 0
-	for k, v := range c.m {
-		if !c.pathMatch(k, path) {
-			continue
-		}
-		if h == nil || len(k) > n {
-			n = len(k)
-			h = v.h
-			pattern = v.pattern
-		}
-	}
-	return
-}
-
-func (c *Crawler) handler(host, path string) (h Handler, pattern string) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
-	h, pattern = c.matchHandler(host + path)
-	if h == nil {
-		h, pattern = c.matchHandler(host)
-	}
-	if h == nil {
-		h, pattern = c.matchHandler("*")
-	}
-	if h == nil {
-		h, pattern = VoidHandler(), ""
-	}
-	return
-}
-
 func (c *Crawler) maxConcurrentRequestsPerSite() int {
 	if v := c.MaxConcurrentRequestsPerSite; v > 0 {
 		return v
@@ -269,6 +682,16 @@ func (c *Crawler) maxConcurrentRequestsPerSite() int {
 	return 1
 }
 
+func (c *Crawler) maxIdleConnsPerHost() int {
+	n := c.maxConcurrentRequestsPerSite()
+	for _, s := range c.Sites {
+		if s.MaxConcurrentRequests > n {
+			n = s.MaxConcurrentRequests
+		}
+	}
+	return n * 2
+}
+
 func (c *Crawler) maxConcurrentRequests() int {
 	if v := c.MaxConcurrentRequests; v > 0 {
 		return v
@@ -290,6 +713,27 @@ func (c *Crawler) downloadDelay() time.Duration {
 	return 250 * time.Millisecond // 0.25s
 }
 
+func (c *Crawler) autoThrottleMaxDelay() time.Duration {
+	if v := c.AutoThrottleMaxDelay; v > 0 {
+		return v
+	}
+	return 60 * time.Second
+}
+
+func (c *Crawler) autoThrottleTargetConcurrency() float64 {
+	if v := c.AutoThrottleTargetConcurrency; v > 0 {
+		return v
+	}
+	return 1.0
+}
+
+func (c *Crawler) robotstxtMaxDelay() time.Duration {
+	if v := c.RobotstxtMaxDelay; v > 0 {
+		return v
+	}
+	return 60 * time.Second
+}
+
 func (c *Crawler) requestTimeout() time.Duration {
 	if v := c.RequestTimeout; v > 0 {
 		return v
@@ -298,19 +742,86 @@ func (c *Crawler) requestTimeout() time.Duration {
 }
 
 func (c *Crawler) init() {
+	// The timeout of each request is depends on its website.
 	c.client = &http.Client{
 		Transport:     c.transport(),
-		CheckRedirect: c.CheckRedirect,
-		Timeout:       c.requestTimeout(),
+		CheckRedirect: c.checkRedirect,
+	}
+	c.offsite = &OffsiteFilter{AllowedDomains: c.AllowedDomains}
+	c.stats = c.StatsCollector
+	if c.stats == nil {
+		c.stats = NewMemoryStats()
 	}
 
 	c.pipeHandler = c.pipeline()
-	c.readCh = make(chan *http.Request)
+	c.scheduler = c.Scheduler
+	if c.JobDir != "" {
+		if c.initErr = c.resume(); c.initErr != nil {
+			c.logf("crawler: restore state from %s got error: %v", c.JobDir, c.initErr)
+		}
+	}
+	if c.scheduler == nil {
+		c.scheduler = NewPriorityQueue()
+	}
+	// The restored requests from the JobDir.
+	c.addPending(c.scheduler.Len())
 	c.writeCh = make(chan Item)
+	c.closing = make(chan struct{})
+	c.closed = make(chan struct{})
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.quit = c.ctx.Done()
+	atomic.StoreInt32(&c.inited, 1)
+	if c.ControlAddr != "" {
+		if err := c.serveControl(); err != nil {
+			c.logf("crawler: listen control server on %s got error: %v", c.ControlAddr, err)
+			if c.initErr == nil {
+				c.initErr = err
+			}
+		}
+	}
+	go func() {
+		select {
+		case <-c.Exit:
+			c.stop()
+		case <-c.quit:
+		}
+	}()
 	go c.readLoop()
 	go c.writeLoop()
 }
 
+func (c *Crawler) checkRedirect(req *http.Request, via []*http.Request) error {
+	if !c.offsite.Allow(req.URL) {
+		return ErrOffsite
+	}
+	if c.CheckRedirect != nil {
+		return c.CheckRedirect(req, via)
+	}
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
+
+// resume restores the crawl state from the JobDir.
+func (c *Crawler) resume() error {
+	if c.scheduler == nil {
+		q, err := NewDiskQueue(c.JobDir)
+		if err != nil {
+			return err
+		}
+		c.scheduler = q
+	}
+	for _, h := range c.msgHandlers {
+		if r, ok := h.(Resumable); ok {
+			if err := r.Resume(c.JobDir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (c *Crawler) scanRequestWork(workCh chan chan *http.Request, closeCh chan int) {
 	reqch := make(chan *http.Request)
 	for {
@@ -318,32 +829,63 @@ func (c *Crawler) scanRequestWork(workCh chan chan *http.Request, closeCh chan i
 		select {
 		case req := <-reqch:
 			resc := make(chan responseAndError)
+			orig := req
 			spider := c.getSpider(req.URL)
 
 			if req.Header.Get("User-Agent") == "" && c.UserAgent != "" {
 				req.Header.Set("User-Agent", c.UserAgent)
 			}
 
-			spider.reqch <- requestAndChan{req: req, ch: resc}
+			// The request is cancelled when the crawler is stopped.
+			ctx, cancel := context.WithCancel(req.Context())
+			go func() {
+				select {
+				case <-c.quit:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			req = req.WithContext(context.WithValue(ctx, statsKey{}, c.stats))
+
+			spider.addQueued(1)
+		send:
+			select {
+			case spider.reqch <- requestAndChan{req: req, ch: resc}:
+			case <-spider.done:
+				// The spider has exited due to idle timeout.
+				spider.addQueued(-1)
+				spider = c.getSpider(req.URL)
+				spider.addQueued(1)
+				goto send
+			case <-closeCh:
+				spider.addQueued(-1)
+				closeRequest(req)
+				cancel()
+				c.addPending(-1)
+				return
+			}
 			select {
 			case re := <-resc:
 				closeRequest(req)
 				if re.err != nil {
-					c.logf("crawler: send HTTP request got error: %v", re.err)
+					cancel()
+					go func(err error) {
+						defer c.addPending(-1)
+						defer c.ack(orig)
+						c.serveError(orig, err)
+					}(re.err)
 				} else {
 					go func(res *http.Response) {
-						defer closeResponse(res)
-						defer func() {
-							if r := recover(); r != nil {
-								c.logf("crawler: Handler got panic error: %v", r)
-							}
-						}()
-						h, _ := c.Handler(res)
-						h.ServeSpider(c.writeCh, res)
+						defer c.addPending(-1)
+						defer c.ack(orig)
+						defer cancel()
+						c.serveResponse(res)
 					}(re.res)
 				}
 			case <-closeCh:
 				closeRequest(req)
+				cancel()
+				c.addPending(-1)
 				return
 			}
 		case <-closeCh:
@@ -352,6 +894,123 @@ func (c *Crawler) scanRequestWork(workCh chan chan *http.Request, closeCh chan i
 	}
 }
 
+// serveResponse calls the Handler for res and dispatches the values
+// written by the Handler until it returns.
+func (c *Crawler) serveResponse(res *http.Response) {
+	c.incStat(res.Request, "responses", 1)
+	c.incStat(res.Request, fmt.Sprintf("responses/status/%d", res.StatusCode), 1)
+	if res.Body != nil {
+		res.Body = &statsBody{ReadCloser: res.Body, c: c, req: res.Request}
+	}
+	defer closeResponse(res)
+
+	h, _, params := c.route(res)
+	if len(params) > 0 {
+		res.Request = withRouteParams(res.Request, params)
+	}
+	c.serve(res.Request, func(ch chan<- Item) {
+		h.ServeSpider(ch, res)
+	})
+}
+
+// serveError calls the ErrorHandler for the failed req and dispatches
+// the values written by the ErrorHandler until it returns.
+func (c *Crawler) serveError(req *http.Request, err error) {
+	if v, ok := err.(*url.Error); ok {
+		// The error of middlewares or transport.
+		err = v.Err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = &timeoutError{err}
+	}
+	h := requestErrorHandler(req)
+	if h == nil {
+		h = c.ErrorHandler
+	}
+	select {
+	case <-c.quit:
+		// The request was cancelled since the Crawler stopped.
+		return
+	default:
+	}
+	switch key := failedStat(err); {
+	case strings.HasPrefix(key, "requests/filtered/"):
+		c.incStat(req, key, 1)
+	case key != "":
+		c.incStat(req, key, 1)
+		fallthrough
+	default:
+		c.incStat(req, "requests/failed", 1)
+	}
+	if h == nil {
+		c.logf("crawler: send HTTP request got error: %v", err)
+		return
+	}
+	c.serve(req, func(ch chan<- Item) {
+		h.ServeError(ch, req, err)
+	})
+}
+
+// serve calls f with a channel and dispatches the values written to
+// the channel as the follow-ups of parent until f returns.
+func (c *Crawler) serve(parent *http.Request, f func(chan<- Item)) {
+	ch := make(chan Item)
+	done := make(chan int)
+	go func() {
+		defer close(done)
+		for v := range ch {
+			c.dispatch(v, parent)
+		}
+	}()
+	defer func() {
+		close(ch)
+		<-done
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			c.incStat(parent, "handlers/panics", 1)
+			c.logf("crawler: Handler got panic error: %v", r)
+		}
+	}()
+	f(ch)
+}
+
+// dispatch writes an Item into the item pipeline, or puts it into
+// the working queue if it is a follow-up HTTP request of parent.
+// The Handler is blocked until v has been accepted.
+func (c *Crawler) dispatch(v Item, parent *http.Request) {
+	switch v := v.(type) {
+	case *http.Request:
+		if v == nil {
+			return
+		}
+		depth := Depth(parent) + 1
+		if c.MaxDepth > 0 && depth > c.MaxDepth {
+			c.incStat(v, "requests/filtered/depth", 1)
+			return
+		}
+		c.stats.Max("", "requests/depth/max", int64(depth))
+		v = withDepth(v, depth)
+		if c.DepthPriority != 0 {
+			v = WithPriority(v, Priority(v)-depth*c.DepthPriority)
+		}
+		c.waitQueue()
+		if err := c.schedule(v); err != nil && err != ErrOffsite {
+			c.logf("crawler: enqueue follow-up request got error: %v", err)
+		}
+	default:
+		c.incStat(parent, "items", 1)
+		c.addPending(1)
+		c.metrics.addPipeline(1)
+		select {
+		case c.writeCh <- v:
+		case <-c.quit:
+			c.metrics.addPipeline(-1)
+			c.addPending(-1)
+		}
+	}
+}
+
 // readLoop reads HTTP crawl request from queue and to execute.
 func (c *Crawler) readLoop() {
 	closeCh := make(chan int)
@@ -363,19 +1022,105 @@ func (c *Crawler) readLoop() {
 		}()
 	}
 
-	for {
+	// putBack puts the request back, it will not be crawled while
+	// the crawler is shutting down.
+	putBack := func(req *http.Request) {
+		if err := c.scheduler.Push(req); err != nil {
+			closeRequest(req)
+			c.addPending(-1)
+		}
+	}
+
+	// The closing and quit are checked before the select, which
+	// chooses randomly if the work is ready too.
+	for !c.stopping() {
+		req, err := c.scheduler.Pop()
+		if err != nil {
+			break
+		}
+		c.popped()
+	wait:
+		// The request is held while the crawl or its site is paused.
+		if c.holdRequest(req) {
+			continue
+		}
+		var work chan chan *http.Request
+		resumed := c.pausedCh("")
+		if resumed == nil {
+			work = workCh
+		}
 		select {
-		case req := <-c.readCh:
-			reqch := <-workCh
+		case reqch := <-work:
+			if c.stopping() {
+				putBack(req)
+				goto exit
+			}
 			reqch <- req
-		case <-c.Exit:
+		case <-resumed:
+			goto wait
+		case <-c.closing:
+			putBack(req)
+			goto exit
+		case <-c.quit:
+			closeRequest(req)
+			c.addPending(-1)
 			goto exit
 		}
 	}
 exit:
+	// The requests in flight are finished before the crawler stopped.
+	<-c.quit
 	close(closeCh)
 }
 
+// waitQueue blocks until the Scheduler is not full, or the Crawler is
+// shutting down. See MaxQueuedRequests.
+func (c *Crawler) waitQueue() {
+	for c.MaxQueuedRequests > 0 {
+		c.popMu.Lock()
+		if c.scheduler.Len() < c.MaxQueuedRequests {
+			c.popMu.Unlock()
+			return
+		}
+		if c.poppedCh == nil {
+			c.poppedCh = make(chan struct{})
+		}
+		ch := c.poppedCh
+		c.popMu.Unlock()
+
+		select {
+		case <-ch:
+		case <-c.closing:
+			return
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// popped wakes up the Handlers blocked in waitQueue.
+func (c *Crawler) popped() {
+	c.popMu.Lock()
+	if c.poppedCh != nil {
+		close(c.poppedCh)
+		c.poppedCh = nil
+	}
+	c.popMu.Unlock()
+}
+
+// stopping reports whether the crawler is closing or stopped,
+// it does not block.
+func (c *Crawler) stopping() bool {
+	select {
+	case <-c.closing:
+		return true
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
+}
+
 // writeLoop writes a received Item into the item pippeline.
 func (c *Crawler) writeLoop() {
 	closeCh := make(chan int)
@@ -389,8 +1134,12 @@ func (c *Crawler) writeLoop() {
 	for {
 		select {
 		case item := <-c.writeCh:
-			workCh <- item
-		case <-c.Exit:
+			select {
+			case workCh <- item:
+			case <-c.quit:
+				goto exit
+			}
+		case <-c.quit:
 			goto exit
 		}
 	}
@@ -405,6 +1154,8 @@ func (c *Crawler) scanPipelineWork(workCh chan Item, closeCh chan int) {
 			done := make(chan int)
 			go func() {
 				defer close(done)
+				defer c.addPending(-1)
+				defer c.metrics.addPipeline(-1)
 				defer func() {
 					if r := recover(); r != nil {
 						c.logf("crawler: Handler got panic error: %v", r)
@@ -439,15 +1190,22 @@ func (c *Crawler) getSpider(url *url.URL) *spider {
 		c.spider = make(map[string]*spider)
 	}
 
-	host, _, _ := net.SplitHostPort(url.Host)
-	key := fmt.Sprintf("%s%s", url.Scheme, host)
+	key := fmt.Sprintf("%s://%s", url.Scheme, url.Hostname())
 	s, ok := c.spider[key]
 	if !ok {
 		s = &spider{
 			c:           c,
 			reqch:       make(chan requestAndChan),
 			key:         key,
+			scheme:      url.Scheme,
+			host:        url.Hostname(),
 			idleTimeout: 120 * time.Second,
+			settings:    c.siteSettings(url.Hostname()),
+			done:        make(chan struct{}),
+		}
+		if c.AutoThrottle {
+			s.throttle = newThrottle(s.settings.DownloadDelay, c.autoThrottleMaxDelay(),
+				c.autoThrottleTargetConcurrency(), s.settings.MaxConcurrentRequests)
 		}
 		c.spider[key] = s
 		go s.crawlLoop()
@@ -455,6 +1213,46 @@ func (c *Crawler) getSpider(url *url.URL) *spider {
 	return s
 }
 
+// crawlDelayer is implemented by the HttpMessageHandler that knows
+// the delay between requests that the website asks for.
+type crawlDelayer interface {
+	CrawlDelay(u *url.URL, agent string) time.Duration
+}
+
+// crawlDelay returns the delay between requests that the website of
+// the req asks for, such as the Crawl-delay of robots.txt.
+func (c *Crawler) crawlDelay(req *http.Request) time.Duration {
+	var d time.Duration
+	for _, h := range c.msgHandlers {
+		if v, ok := h.(crawlDelayer); ok {
+			if t := v.CrawlDelay(req.URL, req.Header.Get("User-Agent")); t > d {
+				d = t
+			}
+		}
+	}
+	if limit := c.robotstxtMaxDelay(); d > limit {
+		d = limit
+	}
+	return d
+}
+
+// cacheChecker is implemented by the HttpMessageHandler that serves
+// the requests from its cache without sending them.
+type cacheChecker interface {
+	isCached(req *http.Request) bool
+}
+
+// isCached reports whether req is served from the cache, such as the
+// HttpCacheMiddleware, it is sent without the download delay.
+func (c *Crawler) isCached(req *http.Request) bool {
+	for _, h := range c.msgHandlers {
+		if v, ok := h.(cacheChecker); ok && v.isCached(req) {
+			return true
+		}
+	}
+	return false
+}
+
 type requestAndChan struct {
 	req *http.Request
 	ch  chan responseAndError
@@ -470,61 +1268,205 @@ type spider struct {
 	c           *Crawler
 	reqch       chan requestAndChan
 	key         string
+	scheme      string
+	host        string
 	idleTimeout time.Duration
+	settings    SiteSettings
+	// done is closed when the spider exits.
+	done chan struct{}
+
+	mu     sync.Mutex
+	active int
+	queued int
+	// freeCh is closed when a slot is released.
+	freeCh   chan struct{}
+	throttle *throttle
+}
+
+// downloadDelay returns the time to wait before sending the req.
+func (s *spider) downloadDelay(req *http.Request) time.Duration {
+	s.mu.Lock()
+	d := s.settings.DownloadDelay
+	if s.throttle != nil {
+		d = s.throttle.delay
+	}
+	s.mu.Unlock()
+
+	if t := s.c.crawlDelay(req); t > d {
+		d = t
+	}
+	return d
+}
+
+// addQueued adds delta to the number of requests that have been
+// dispatched to the spider but not sent yet.
+func (s *spider) addQueued(delta int) {
+	s.mu.Lock()
+	s.queued += delta
+	s.mu.Unlock()
 }
 
-func (s *spider) queueScanWorker(workCh chan chan requestAndChan, closeCh chan struct{}) {
-	rc := make(chan requestAndChan)
+// acquire takes a slot of the site if a new request can be sent to
+// it, or returns a channel that is closed when a slot is released.
+func (s *spider) acquire() (bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.settings.MaxConcurrentRequests
+	if s.throttle != nil {
+		n = s.throttle.concurrency
+	}
+	if s.active < n {
+		s.active++
+		return true, nil
+	}
+	if s.freeCh == nil {
+		s.freeCh = make(chan struct{})
+	}
+	return false, s.freeCh
+}
+
+// waitAcquire blocks until a slot of the site is taken. It returns
+// false if the cancel is closed.
+func (s *spider) waitAcquire(cancel <-chan struct{}) bool {
 	for {
-		workCh <- rc
+		ok, free := s.acquire()
+		if ok {
+			return true
+		}
 		select {
-		case c := <-rc:
-			resp, err := s.c.client.Do(c.req)
-			select {
-			case c.ch <- responseAndError{resp, err}:
-			case <-closeCh:
-				return
-			}
-		case <-closeCh:
-			return
+		case <-free:
+		case <-cancel:
+			return false
 		}
 	}
 }
 
-func (s *spider) crawlLoop() {
-	closeCh := make(chan struct{})
-	idleTimer := time.NewTimer(s.idleTimeout)
-	workCh := make(chan chan requestAndChan, s.c.maxConcurrentRequestsPerSite())
+// free releases a slot of the site.
+func (s *spider) free() {
+	s.mu.Lock()
+	s.active--
+	if s.freeCh != nil {
+		close(s.freeCh)
+		s.freeCh = nil
+	}
+	s.mu.Unlock()
+}
 
-	for i := 0; i < s.c.maxConcurrentRequestsPerSite(); i++ {
-		go func() {
-			s.queueScanWorker(workCh, closeCh)
-		}()
+// observe is called when an attempt of a request to the site has
+// got the response or error.
+func (s *spider) observe(u *url.URL, latency time.Duration, resp *http.Response, err error) {
+	s.c.metrics.observeLatency(u, latency)
+	if s.throttle != nil {
+		s.mu.Lock()
+		s.throttle.update(latency, resp, err)
+		s.mu.Unlock()
 	}
+}
+
+type slotKey struct{}
+
+// slot is the slot of the site taken by a request, it is released by
+// RetryMiddleware while waiting to retry the request.
+type slot struct {
+	s    *spider
+	held bool
+}
+
+func (sl *slot) release() {
+	if sl.held {
+		sl.held = false
+		sl.s.free()
+	}
+}
+
+// acquire takes the slot again, it returns false if cancel is closed.
+func (sl *slot) acquire(cancel <-chan struct{}) bool {
+	if !sl.held {
+		sl.held = sl.s.waitAcquire(cancel)
+	}
+	return sl.held
+}
+
+type timeoutKey struct{}
+
+func (s *spider) fetch(rc requestAndChan, held bool) {
+	// The timeout is applied to each attempt when it is sent, the
+	// time waiting for the download delay or a free slot is not
+	// counted.
+	sl := &slot{s: s, held: held}
+	ctx := context.WithValue(rc.req.Context(), timeoutKey{}, s.settings.RequestTimeout)
+	req := rc.req.WithContext(context.WithValue(ctx, slotKey{}, sl))
+	s.c.incStat(req, "requests/sent", 1)
+	resp, err := s.c.client.Do(req)
+	sl.release()
+	select {
+	case rc.ch <- responseAndError{resp, err}:
+	case <-s.c.quit:
+		closeResponse(resp)
+	}
+}
+
+func (s *spider) crawlLoop() {
+	idleTimer := time.NewTimer(s.idleTimeout)
 
 	for {
 		select {
 		case rc := <-s.reqch:
+			// Wait until the site is resumed, the dispatched requests
+			// are sent anyway when the Crawler is shutting down.
+		paused:
+			for ch := s.c.pausedCh(s.host); ch != nil; ch = s.c.pausedCh(s.host) {
+				select {
+				case <-ch:
+				case <-s.c.closing:
+					break paused
+				case <-s.c.quit:
+					goto exit
+				}
+			}
+			// The cached response is served without waiting for the
+			// download delay and a free slot.
+			if s.c.isCached(rc.req) {
+				s.addQueued(-1)
+				go s.fetch(rc, false)
+				idleTimer.Reset(s.idleTimeout)
+				continue
+			}
 			// Wait a moment time before start fetching.
-			if t := s.c.downloadDelay(); t > 0 {
-				<-time.After(t)
+			if t := s.downloadDelay(rc.req); t > 0 {
+				select {
+				case <-time.After(t):
+				case <-s.c.quit:
+					goto exit
+				}
+			}
+			if !s.waitAcquire(s.c.quit) {
+				goto exit
 			}
-			go func(rc requestAndChan) {
-				c := <-workCh
-				c <- rc
-			}(rc)
+			s.addQueued(-1)
+			go s.fetch(rc, true)
 			idleTimer.Reset(s.idleTimeout)
 		case <-idleTimer.C:
+			s.mu.Lock()
+			active := s.active
+			s.mu.Unlock()
+			if active > 0 {
+				idleTimer.Reset(s.idleTimeout)
+				continue
+			}
 			goto exit
-		case <-s.c.Exit:
+		case <-s.c.quit:
 			goto exit
 		}
 	}
 
 exit:
 	s.c.removeSpider(s)
-	close(closeCh)
 	idleTimer.Stop()
+	if s.done != nil {
+		close(s.done)
+	}
 }
 
 func closeRequest(r *http.Request) {
@@ -533,6 +1475,19 @@ func closeRequest(r *http.Request) {
 	}
 }
 
+// cancelBody cancels the context of the request when the response
+// body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
 func closeResponse(r *http.Response) {
 	if r != nil && r.Body != nil {
 		r.Body.Close()
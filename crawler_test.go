@@ -1,12 +1,19 @@
 package antch
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -42,6 +49,472 @@ func TestCrawlerBasic(t *testing.T) {
 	}
 }
 
+func TestCrawlerFollowRequest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	detail := HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		b, _ := ioutil.ReadAll(resp.Body)
+		c <- string(b)
+	})
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		req, err := http.NewRequest("GET", ts.URL+"/detail", nil)
+		if err != nil {
+			t.Errorf("NewRequest failed: %v", err)
+			return
+		}
+		c <- WithHandler(req, detail)
+	}))
+
+	c := make(chan Item)
+	tc.UsePipeline(func(_ PipelineHandler) PipelineHandler {
+		return PipelineHandlerFunc(func(v Item) {
+			c <- v
+		})
+	})
+
+	tc.StartURLs([]string{ts.URL})
+	if g, e := (<-c).(string), "/detail"; g != e {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestCrawlerRequestHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/item":
+			// The attached Handler is kept across redirects.
+			http.Redirect(w, r, "/item/1", http.StatusFound)
+		default:
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+	defer ts.Close()
+
+	var (
+		mu    sync.Mutex
+		items []string
+	)
+	newHandler := func(name string, next Handler, URL string) Handler {
+		return HandlerFunc(func(c chan<- Item, resp *http.Response) {
+			mu.Lock()
+			items = append(items, name+":"+resp.Request.URL.Path)
+			mu.Unlock()
+			if next != nil {
+				req, _ := http.NewRequest("GET", ts.URL+URL, nil)
+				c <- WithHandler(req, next)
+			}
+		})
+	}
+	reviews := newHandler("reviews", nil, "")
+	detail := newHandler("detail", reviews, "/api/reviews?id=1")
+	list := newHandler("list", detail, "/item")
+
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.Handle("*", newHandler("default", nil, ""))
+	tc.EnqueueURLWithHandler(ts.URL+"/list", list)
+	tc.EnqueueURL(ts.URL + "/other")
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	want := []string{"default:/other", "detail:/item/1", "list:/list", "reviews:/api/reviews"}
+	sort.Strings(items)
+	if g, e := fmt.Sprint(items), fmt.Sprint(want); g != e {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestCrawlerErrorHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	errDenied := errors.New("denied")
+	var (
+		mu    sync.Mutex
+		items []string
+	)
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.UseMiddleware(func(next HttpMessageHandler) HttpMessageHandler {
+		return HttpMessageHandlerFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "/denied" {
+				return nil, errDenied
+			}
+			return next.Send(req)
+		})
+	})
+	tc.ErrorHandler = ErrorHandlerFunc(func(c chan<- Item, req *http.Request, err error) {
+		if err != errDenied {
+			t.Errorf("expected %v; got %v", errDenied, err)
+		}
+		c <- "failed:" + req.URL.Path
+	})
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		c <- "ok:" + resp.Request.URL.Path
+	}))
+	tc.UsePipeline(func(_ PipelineHandler) PipelineHandler {
+		return PipelineHandlerFunc(func(v Item) {
+			mu.Lock()
+			items = append(items, v.(string))
+			mu.Unlock()
+		})
+	})
+
+	// Reschedules the request to another server.
+	req, _ := http.NewRequest("GET", closed.URL+"/retry", nil)
+	tc.Crawl(WithErrorHandler(req, ErrorHandlerFunc(func(c chan<- Item, req *http.Request, err error) {
+		req, _ = http.NewRequest("GET", ts.URL+req.URL.Path, nil)
+		c <- req
+	})))
+	tc.EnqueueURL(ts.URL + "/denied")
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	want := []string{"failed:/denied", "ok:/retry"}
+	sort.Strings(items)
+	if g, e := fmt.Sprint(items), fmt.Sprint(want); g != e {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestCrawlerErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			w.Write([]byte("User-agent: *\nDisallow: /private/\n"))
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	proxyURL, _ := url.Parse(closed.URL)
+
+	serveError := func(tc *Crawler, URL string) error {
+		var got error
+		if tc.DownloadDelay == 0 {
+			tc.DownloadDelay = time.Millisecond
+		}
+		tc.ErrorHandler = ErrorHandlerFunc(func(_ chan<- Item, _ *http.Request, err error) {
+			got = err
+		})
+		tc.EnqueueURL(URL)
+		if err := tc.Run(context.Background()); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		return got
+	}
+
+	tc := NewCrawler().UseRobotstxt()
+	if err := serveError(tc, ts.URL+"/private/1"); !errors.Is(err, ErrRobotsDenied) {
+		t.Errorf("expected %v; got %v", ErrRobotsDenied, err)
+	}
+
+	tc = NewCrawler().UseMiddleware(OffsiteMiddleware(&OffsiteFilter{AllowedDomains: []string{"example.com"}}))
+	if err := serveError(tc, ts.URL); !errors.Is(err, ErrOffsite) {
+		t.Errorf("expected %v; got %v", ErrOffsite, err)
+	}
+
+	tc = NewCrawler()
+	tc.RequestTimeout = 10 * time.Millisecond
+	err := serveError(tc, ts.URL+"/slow")
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected %v; got %v", ErrTimeout, err)
+	}
+	if v, ok := err.(net.Error); !ok || !v.Timeout() {
+		t.Errorf("expected a net.Error with timeout; got %v", err)
+	}
+
+	// The time waiting for the download delay is not counted.
+	tc = NewCrawler()
+	tc.RequestTimeout = 50 * time.Millisecond
+	tc.DownloadDelay = 100 * time.Millisecond
+	if err := serveError(tc, ts.URL); err != nil {
+		t.Errorf("expected no error; got %v", err)
+	}
+
+	tc = NewCrawler().UseProxy(proxyURL)
+	var perr *ProxyError
+	if err := serveError(tc, ts.URL); !errors.As(err, &perr) || perr.URL != proxyURL {
+		t.Errorf("expected ProxyError of %s; got %v", proxyURL, err)
+	}
+}
+
+func TestCrawlerDepth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/1" {
+			// The depth is kept across redirects.
+			http.Redirect(w, r, "/1r", http.StatusFound)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	var (
+		mu    sync.Mutex
+		items []string
+	)
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.MaxDepth = 2
+	tc.DepthPriority = 1
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		req := resp.Request
+		mu.Lock()
+		items = append(items, fmt.Sprintf("%s:%d:%d", req.URL.Path, Depth(req), Priority(req)))
+		mu.Unlock()
+		next, _ := http.NewRequest("GET", fmt.Sprintf("%s/%d", ts.URL, Depth(req)+1), nil)
+		c <- next
+	}))
+	tc.StartURLs([]string{ts.URL + "/0"})
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if g, e := fmt.Sprint(items), "[/0:0:0 /1r:1:-1 /2:2:-2]"; g != e {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	stats := tc.Stats()[""]
+	for i := 0; i <= 2; i++ {
+		if g, e := stats[fmt.Sprintf("requests/depth/%d", i)], int64(1); g != e {
+			t.Errorf("expected %d requests of depth %d; got %d", e, i, g)
+		}
+	}
+}
+
+func TestCrawlerRequestMeta(t *testing.T) {
+	var n int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/item", http.StatusMovedPermanently)
+		case "/item":
+			if atomic.AddInt32(&n, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.UseMiddleware(RetryMiddleware(RetryPolicy{BaseDelay: time.Millisecond}))
+	item := HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		meta := RequestMeta(resp.Request)
+		c <- fmt.Sprintf("%s:%s:%d", resp.Request.URL.Path, meta.String("category"), meta.Int("page"))
+	})
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		req, _ := http.NewRequest("GET", ts.URL+"/old", nil)
+		c <- WithHandler(WithMeta(req, Meta{"category": "books", "page": 2}), item)
+	}))
+
+	c := make(chan Item)
+	tc.UsePipeline(func(_ PipelineHandler) PipelineHandler {
+		return PipelineHandlerFunc(func(v Item) {
+			c <- v
+		})
+	})
+
+	tc.StartURLs([]string{ts.URL + "/list"})
+	if g, e := (<-c).(string), "/item:books:2"; g != e {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestCrawlerWait(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		if resp.Request.URL.Path == "/" {
+			for _, path := range []string{"/a", "/b", "/c"} {
+				req, _ := http.NewRequest("GET", ts.URL+path, nil)
+				c <- req
+			}
+		}
+		c <- resp.Request.URL.Path
+	}))
+
+	var (
+		mu    sync.Mutex
+		items []string
+	)
+	tc.UsePipeline(func(_ PipelineHandler) PipelineHandler {
+		return PipelineHandlerFunc(func(v Item) {
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			items = append(items, v.(string))
+			mu.Unlock()
+		})
+	})
+
+	tc.StartURLs([]string{ts.URL + "/"})
+	done := make(chan struct{})
+	go func() {
+		tc.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait() was not returned after the crawl finished")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if g, e := len(items), 4; g != e {
+		t.Errorf("expected %d items before Wait returned; got %d", e, g)
+	}
+}
+
+type closerPipeline struct {
+	PipelineHandler
+	closed bool
+}
+
+func (p *closerPipeline) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestCrawlerShutdown(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		c <- resp.Request.URL.Path
+	}))
+	var (
+		mu    sync.Mutex
+		items []string
+		pipe  = &closerPipeline{}
+	)
+	tc.UsePipeline(func(_ PipelineHandler) PipelineHandler {
+		pipe.PipelineHandler = PipelineHandlerFunc(func(v Item) {
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			items = append(items, v.(string))
+			mu.Unlock()
+		})
+		return pipe
+	})
+
+	tc.StartURLs([]string{ts.URL + "/a"})
+	// Waiting for the request is in flight.
+	time.Sleep(10 * time.Millisecond)
+	if err := tc.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	mu.Lock()
+	if g, e := len(items), 1; g != e {
+		t.Errorf("expected %d items after Shutdown; got %d", e, g)
+	}
+	mu.Unlock()
+	if !pipe.closed {
+		t.Error("pipeline was not closed by Shutdown")
+	}
+	if err := tc.EnqueueURL(ts.URL); err != ErrCrawlerClosed {
+		t.Errorf("EnqueueURL() err = %v; want %v", err, ErrCrawlerClosed)
+	}
+}
+
+func TestCrawlerShutdownTimeout(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	tc := NewCrawler()
+	tc.StartURLs([]string{ts.URL})
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := tc.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() err = %v; want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestCrawlerRun(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	n := 0
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		c <- resp.StatusCode
+	}))
+	tc.UsePipeline(func(_ PipelineHandler) PipelineHandler {
+		return PipelineHandlerFunc(func(v Item) {
+			n++
+		})
+	})
+	tc.StartURLs([]string{ts.URL})
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 item after Run returned; got %d", n)
+	}
+}
+
+func TestCrawlerRunCancel(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.StartURLs([]string{ts.URL})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	if err := tc.Run(ctx); err != context.Canceled {
+		t.Errorf("Run() err = %v; want %v", err, context.Canceled)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("the outstanding request was not cancelled")
+	}
+}
+
 func TestCrawlerSpiderMux(t *testing.T) {
 	var serveFakes = []struct {
 		host string
@@ -113,6 +586,39 @@ func TestSpiderIdleTimeout(t *testing.T) {
 	}
 }
 
+func TestSpiderConcurrency(t *testing.T) {
+	var (
+		mu           sync.Mutex
+		active, peak int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.MaxConcurrentRequestsPerSite = 2
+	for i := 0; i < 6; i++ {
+		tc.EnqueueURL(fmt.Sprintf("%s/%d", ts.URL, i))
+	}
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if g, e := peak, 2; g != e {
+		t.Errorf("expected %d concurrent requests; got %d", e, g)
+	}
+}
+
 func TestCrawlerNilLogger(t *testing.T) {
 	loggers := []Logger{
 		log.New(os.Stdout, "", log.LstdFlags),
@@ -0,0 +1,289 @@
+package antch
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	journalFile = "requests.queue"
+	// compactSize is the minimum number of popped records in journal
+	// file before it will be compacted.
+	compactSize = 1024
+)
+
+// journalRecord is a line of the journal file.
+type journalRecord struct {
+	Op         string      `json:"op"`
+	Seq        uint64      `json:"seq"`
+	Method     string      `json:"method,omitempty"`
+	URL        string      `json:"url,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+	Priority   int         `json:"priority,omitempty"`
+	Depth      int         `json:"depth,omitempty"`
+	Meta       Meta        `json:"meta,omitempty"`
+	DontFilter bool        `json:"dont_filter,omitempty"`
+}
+
+func newPushRecord(item *queueItem) (*journalRecord, error) {
+	req := item.req
+	r := &journalRecord{
+		Op:         "push",
+		Seq:        item.seq,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Header:     req.Header,
+		Priority:   item.priority,
+		Depth:      Depth(req),
+		Meta:       RequestMeta(req),
+		DontFilter: DontFilter(req),
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		r.Body = b
+	}
+	return r, nil
+}
+
+func (r *journalRecord) item() (*queueItem, error) {
+	var body io.Reader
+	if r.Body != nil {
+		body = bytes.NewReader(r.Body)
+	}
+	req, err := http.NewRequest(r.Method, r.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	if r.Header != nil {
+		req.Header = r.Header
+	}
+	if r.Priority != 0 {
+		req = WithPriority(req, r.Priority)
+	}
+	if r.Depth != 0 {
+		req = withDepth(req, r.Depth)
+	}
+	if r.Meta != nil {
+		req = WithMeta(req, r.Meta)
+	}
+	if r.DontFilter {
+		req = WithDontFilter(req)
+	}
+	return &queueItem{req: req, priority: r.Priority, seq: r.Seq, rec: r}, nil
+}
+
+// journal is an append-only log of the push, take and pop operations
+// of the priority queue.
+type journal struct {
+	path    string
+	f       *os.File
+	garbage int
+}
+
+func (j *journal) write(r *journalRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = j.f.Write(append(b, '\n'))
+	return err
+}
+
+func (j *journal) push(item *queueItem) error {
+	r, err := newPushRecord(item)
+	if err != nil {
+		return err
+	}
+	item.rec = r
+	return j.write(r)
+}
+
+// repush records the popped request is put back with the record rec
+// of it.
+func (j *journal) repush(item *queueItem, rec *journalRecord) error {
+	r := *rec
+	r.Seq = item.seq
+	item.rec = &r
+	return j.write(&r)
+}
+
+// take records the request has been popped and is in flight.
+func (j *journal) take(item *queueItem) error {
+	return j.write(&journalRecord{Op: "take", Seq: item.seq})
+}
+
+// pop records the request has been finished.
+func (j *journal) pop(item *queueItem) error {
+	if err := j.write(&journalRecord{Op: "pop", Seq: item.seq}); err != nil {
+		return err
+	}
+	j.garbage++
+	return nil
+}
+
+// compact rewrites the journal file that only contains the requests
+// still in the queue or in flight. The records of the requests are
+// reused, the bodies of them may have been read.
+func (j *journal) compact(items requestHeap, inflight map[*http.Request]*queueItem) error {
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	records := make([]*journalRecord, 0, len(items)+len(inflight))
+	for _, item := range items {
+		records = append(records, item.rec)
+	}
+	for _, item := range inflight {
+		// The request in flight may have been seen by the
+		// dupe filters, see replay.
+		r := *item.rec
+		r.DontFilter = true
+		records = append(records, &r)
+	}
+	for _, r := range records {
+		b, err := json.Marshal(r)
+		if err == nil {
+			_, err = w.Write(append(b, '\n'))
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	j.f.Close()
+	if j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	j.garbage = 0
+	return nil
+}
+
+// replay reads the journal file and returns the requests that
+// has not been finished yet. The requests that were in flight are
+// restored with WithDontFilter, they may have been seen by the dupe
+// filters such as the fingerprints of RFPDupeFilter.
+func (j *journal) replay() (requestHeap, uint64, error) {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var (
+		seq   uint64
+		m     = make(map[uint64]*journalRecord)
+		taken = make(map[uint64]bool)
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var r journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// The last line may be incomplete if the process
+			// crashed while writing it.
+			break
+		}
+		switch r.Op {
+		case "push":
+			m[r.Seq] = &r
+		case "take":
+			taken[r.Seq] = true
+		case "pop":
+			delete(m, r.Seq)
+			delete(taken, r.Seq)
+		}
+		if r.Seq > seq {
+			seq = r.Seq
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	var items requestHeap
+	for _, r := range m {
+		if taken[r.Seq] {
+			r.DontFilter = true
+		}
+		item, err := r.item()
+		if err != nil {
+			return nil, 0, err
+		}
+		items = append(items, item)
+	}
+	return items, seq, nil
+}
+
+func (j *journal) Close() error {
+	return j.f.Close()
+}
+
+// NewDiskQueue returns a new priority queue Scheduler that keeps the
+// requests in the directory dir, so that pending requests survive
+// a restart of the crawl process. Requests in dir that left by the
+// previous process are restored.
+//
+// A popped request is kept in dir until it is acked by the Crawler
+// after its Handler returned, the requests that were in flight when
+// the process crashed are crawled again, bypassing the dupe filters.
+//
+// The method, URL, header, body, priority, depth and meta of requests are
+// stored, the Handler attached by WithHandler is not.
+func NewDiskQueue(dir string) (Scheduler, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	j := &journal{path: filepath.Join(dir, journalFile)}
+	items, seq, err := j.replay()
+	if err != nil {
+		return nil, err
+	}
+	j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.compact(items, nil); err != nil {
+		j.Close()
+		return nil, err
+	}
+
+	q := &priorityQueue{
+		items:    items,
+		seq:      seq,
+		journal:  j,
+		inflight: make(map[*http.Request]*queueItem),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	heap.Init(&q.items)
+	return q, nil
+}
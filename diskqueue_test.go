@@ -0,0 +1,227 @@
+package antch
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiskQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "antch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewDiskQueue(dir)
+	if err != nil {
+		t.Fatalf("NewDiskQueue failed: %v", err)
+	}
+	urls := []string{
+		"http://example.com/1",
+		"http://example.com/2",
+		"http://example.com/3",
+	}
+	for i, u := range urls {
+		req, _ := http.NewRequest("POST", u, strings.NewReader("q=go"))
+		req.Header.Set("X-Test", "test")
+		req = WithMeta(withDepth(WithPriority(req, i), i+1), Meta{"page": i})
+		q.Push(WithDontFilter(req))
+	}
+	// Pops the request with highest priority before close.
+	req, _ := q.Pop()
+	if req.URL.String() != urls[2] {
+		t.Errorf("expected %s; got %s", urls[2], req.URL)
+	}
+	if err := q.(Acker).Ack(req); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	// The request is in flight and not acked.
+	if req, _ := q.Pop(); req.URL.String() != urls[1] {
+		t.Errorf("expected %s; got %s", urls[1], req.URL)
+	}
+	q.Close()
+
+	q, err = NewDiskQueue(dir)
+	if err != nil {
+		t.Fatalf("NewDiskQueue failed: %v", err)
+	}
+	defer q.Close()
+	if g, e := q.Len(), 2; g != e {
+		t.Fatalf("Len() expected %d; got %d", e, g)
+	}
+	for i := 1; i >= 0; i-- {
+		req, err := q.Pop()
+		if err != nil {
+			t.Fatalf("Pop failed: %v", err)
+		}
+		if g, e := req.URL.String(), urls[i]; g != e {
+			t.Errorf("expected %s; got %s", e, g)
+		}
+		if g, e := Priority(req), i; g != e {
+			t.Errorf("Priority() expected %d; got %d", e, g)
+		}
+		if g, e := Depth(req), i+1; g != e {
+			t.Errorf("Depth() expected %d; got %d", e, g)
+		}
+		if g, e := RequestMeta(req).Int("page"), i; g != e {
+			t.Errorf("meta expected %d; got %d", e, g)
+		}
+		if !DontFilter(req) {
+			t.Error("DontFilter() expected true; got false")
+		}
+		if g, e := req.Header.Get("X-Test"), "test"; g != e {
+			t.Errorf("header expected %s; got %s", e, g)
+		}
+		if b, _ := ioutil.ReadAll(req.Body); string(b) != "q=go" {
+			t.Errorf("body expected q=go; got %s", b)
+		}
+	}
+}
+
+func TestDiskQueueCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "antch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewDiskQueue(dir)
+	if err != nil {
+		t.Fatalf("NewDiskQueue failed: %v", err)
+	}
+	req, _ := http.NewRequest("POST", "http://example.com/inflight", strings.NewReader("q=go"))
+	q.Push(req)
+	req, _ = q.Pop()
+	// The body of the request in flight is sent.
+	ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	for i := 0; i < compactSize*2; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		q.Push(req)
+		q.Pop()
+		if err := q.(Acker).Ack(req); err != nil {
+			t.Fatalf("Ack failed: %v", err)
+		}
+	}
+	fi, err := os.Stat(dir + "/" + journalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each record has at least 10 bytes.
+	if fi.Size() > compactSize*2*10 {
+		t.Errorf("journal file was not compacted, size is %d", fi.Size())
+	}
+	q.Close()
+
+	// The request in flight is kept by compaction.
+	q, err = NewDiskQueue(dir)
+	if err != nil {
+		t.Fatalf("NewDiskQueue failed: %v", err)
+	}
+	defer q.Close()
+	if g, e := q.Len(), 1; g != e {
+		t.Fatalf("Len() expected %d; got %d", e, g)
+	}
+	req, _ = q.Pop()
+	if req.URL.Path != "/inflight" {
+		t.Errorf("expected /inflight; got %s", req.URL)
+	}
+	if b, _ := ioutil.ReadAll(req.Body); string(b) != "q=go" {
+		t.Errorf("body expected q=go; got %s", b)
+	}
+	// The request may have been seen by the dupe filters.
+	if !DontFilter(req) {
+		t.Error("DontFilter() expected true; got false")
+	}
+}
+
+func TestCrawlerJobDir(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "antch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The request was left by previous crawl.
+	q, err := NewDiskQueue(dir)
+	if err != nil {
+		t.Fatalf("NewDiskQueue failed: %v", err)
+	}
+	req, _ := http.NewRequest("GET", ts.URL+"/pending", nil)
+	q.Push(req)
+	q.Close()
+
+	tc := NewCrawler()
+	tc.JobDir = dir
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		b, _ := ioutil.ReadAll(resp.Body)
+		c <- string(b)
+	}))
+	c := make(chan Item)
+	tc.UsePipeline(func(_ PipelineHandler) PipelineHandler {
+		return PipelineHandlerFunc(func(v Item) {
+			c <- v
+		})
+	})
+	tc.StartURLs(nil)
+
+	select {
+	case v := <-c:
+		if g, e := v.(string), "/pending"; g != e {
+			t.Errorf("expected %s; got %s", e, g)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pending request was not restored")
+	}
+}
+
+// ackScheduler records the acked requests.
+type ackScheduler struct {
+	Scheduler
+	acked int32
+}
+
+func (s *ackScheduler) Ack(req *http.Request) error {
+	atomic.AddInt32(&s.acked, 1)
+	return nil
+}
+
+func TestCrawlerCancelNotAcked(t *testing.T) {
+	started := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	s := &ackScheduler{Scheduler: NewPriorityQueue()}
+	tc := NewCrawler()
+	tc.Scheduler = s
+	tc.ErrorHandler = ErrorHandlerFunc(func(_ chan<- Item, _ *http.Request, _ error) {})
+	tc.StartURLs([]string{ts.URL})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	if err := tc.Run(ctx); err != context.Canceled {
+		t.Fatalf("expected %v; got %v", context.Canceled, err)
+	}
+	// The cancelled request will be crawled again after restart.
+	time.Sleep(50 * time.Millisecond)
+	if g := atomic.LoadInt32(&s.acked); g != 0 {
+		t.Errorf("expected no requests acked; got %d", g)
+	}
+}
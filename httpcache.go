@@ -0,0 +1,531 @@
+package antch
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HttpCacheSettings specifies how the HttpCacheMiddleware caches the
+// HTTP responses.
+type HttpCacheSettings struct {
+	// Dir specifies the directory of the FilesystemCacheStorage, it is
+	// used only if Storage is nil.
+	// Default is "httpcache".
+	Dir string
+
+	// Storage specifies the storage of the cached responses.
+	// If nil, the FilesystemCacheStorage in the Dir is used.
+	Storage CacheStorage
+
+	// Policy specifies which responses are cached and whether the
+	// cached responses are used.
+	// If nil, DummyCachePolicy is used.
+	Policy CachePolicy
+
+	// Expiration specifies the time after that the cached responses
+	// are expired, the requests are downloaded again.
+	// If zero, the cached responses never expire.
+	Expiration time.Duration
+
+	// IgnoreStatusCodes specifies the HTTP status codes of the responses
+	// that should not be cached, such as 500 and 503.
+	IgnoreStatusCodes []int
+}
+
+// CacheStorage is the interface of the storage that keeps the cached
+// responses of HttpCacheMiddleware.
+type CacheStorage interface {
+	// Retrieve returns the cached response of req and the time it was
+	// stored. It returns a nil response if req is not cached.
+	Retrieve(req *http.Request) (resp *http.Response, stored time.Time, err error)
+
+	// Store stores the resp of req, body is the content of the resp
+	// that has been read.
+	Store(req *http.Request, resp *http.Response, body []byte) error
+}
+
+// CachePolicy is the interface that decides which HTTP requests and
+// responses are cached, and whether the cached responses are used.
+type CachePolicy interface {
+	// ShouldCacheRequest reports whether req can be served from the
+	// cache, and its response can be stored.
+	ShouldCacheRequest(req *http.Request) bool
+
+	// ShouldCacheResponse reports whether resp of req should be stored.
+	ShouldCacheResponse(resp *http.Response, req *http.Request) bool
+
+	// IsCachedResponseFresh reports whether the cached response can be
+	// used without sending req to the remote server. If it is not fresh,
+	// req is sent with the If-None-Match and If-Modified-Since headers
+	// that from the ETag and Last-Modified of the cached response.
+	IsCachedResponseFresh(cached *http.Response, req *http.Request) bool
+
+	// IsCachedResponseValid reports whether the cached response can be
+	// used after req has been sent and got resp, such as resp is 304
+	// Not Modified.
+	IsCachedResponseValid(cached, resp *http.Response, req *http.Request) bool
+}
+
+// DummyCachePolicy is the CachePolicy that caches all requests and
+// responses, and always uses the cached responses without contacting
+// the remote server. It is useful for the development of spiders,
+// the pages are downloaded only once.
+type DummyCachePolicy struct{}
+
+func (DummyCachePolicy) ShouldCacheRequest(req *http.Request) bool {
+	return true
+}
+
+func (DummyCachePolicy) ShouldCacheResponse(resp *http.Response, req *http.Request) bool {
+	return true
+}
+
+func (DummyCachePolicy) IsCachedResponseFresh(cached *http.Response, req *http.Request) bool {
+	return true
+}
+
+func (DummyCachePolicy) IsCachedResponseValid(cached, resp *http.Response, req *http.Request) bool {
+	return true
+}
+
+// RFC7234CachePolicy is the CachePolicy that follows the HTTP caching
+// of RFC 7234 as a private cache. It honours the Cache-Control and
+// Expires headers, and revalidates the stale responses with the
+// ETag and Last-Modified headers. A response without the freshness
+// information is fresh for 10% of the time since its Last-Modified.
+//
+// The GET requests are cached only. The stale cached response is used
+// if the revalidation got a server error, unless it must revalidate.
+type RFC7234CachePolicy struct{}
+
+func (RFC7234CachePolicy) ShouldCacheRequest(req *http.Request) bool {
+	if req.Method != "" && req.Method != "GET" {
+		return false
+	}
+	_, ok := parseCacheControl(req.Header)["no-store"]
+	return !ok
+}
+
+func (RFC7234CachePolicy) ShouldCacheResponse(resp *http.Response, req *http.Request) bool {
+	cc := parseCacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	if _, ok := cc["max-age"]; ok {
+		return true
+	}
+	if resp.Header.Get("Expires") != "" {
+		return true
+	}
+	switch resp.StatusCode {
+	case 300, 301, 308:
+		return true
+	case 200, 203, 401:
+		// It can be revalidated.
+		return resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+	}
+	return false
+}
+
+func (RFC7234CachePolicy) IsCachedResponseFresh(cached *http.Response, req *http.Request) bool {
+	reqCC, respCC := parseCacheControl(req.Header), parseCacheControl(cached.Header)
+	if _, ok := reqCC["no-cache"]; ok {
+		return false
+	}
+	if _, ok := respCC["no-cache"]; ok {
+		return false
+	}
+	date, err := http.ParseTime(cached.Header.Get("Date"))
+	if err != nil {
+		return false
+	}
+
+	lifetime := freshnessLifetime(cached.Header, respCC, date)
+	age := time.Now().Sub(date)
+	if v, err := strconv.Atoi(cached.Header.Get("Age")); err == nil {
+		if d := time.Duration(v) * time.Second; d > age {
+			age = d
+		}
+	}
+	if d, ok := cacheControlSeconds(reqCC, "max-age"); ok && d < lifetime {
+		lifetime = d
+	}
+	if d, ok := cacheControlSeconds(reqCC, "min-fresh"); ok {
+		age += d
+	}
+	if v, ok := reqCC["max-stale"]; ok {
+		if _, must := respCC["must-revalidate"]; !must {
+			if v == "" {
+				// Accepts a stale response of any age.
+				return true
+			}
+			if d, ok := cacheControlSeconds(reqCC, "max-stale"); ok {
+				lifetime += d
+			}
+		}
+	}
+	return age < lifetime
+}
+
+func (RFC7234CachePolicy) IsCachedResponseValid(cached, resp *http.Response, req *http.Request) bool {
+	if resp.StatusCode == http.StatusNotModified {
+		return true
+	}
+	if resp.StatusCode >= 500 {
+		_, must := parseCacheControl(cached.Header)["must-revalidate"]
+		return !must
+	}
+	return false
+}
+
+// freshnessLifetime returns the freshness lifetime of the response
+// by its headers, see RFC 7234 section 4.2.1.
+func freshnessLifetime(h http.Header, cc map[string]string, date time.Time) time.Duration {
+	if d, ok := cacheControlSeconds(cc, "max-age"); ok {
+		return d
+	}
+	if v := h.Get("Expires"); v != "" {
+		t, err := http.ParseTime(v)
+		if err != nil {
+			// An invalid date means in the past.
+			return 0
+		}
+		return t.Sub(date)
+	}
+	if t, err := http.ParseTime(h.Get("Last-Modified")); err == nil && t.Before(date) {
+		return date.Sub(t) / 10
+	}
+	return 0
+}
+
+// parseCacheControl returns the directives of the Cache-Control
+// header, the names are lower case.
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, line := range h["Cache-Control"] {
+		for _, v := range strings.Split(line, ",") {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			name, value := v, ""
+			if i := strings.Index(v, "="); i >= 0 {
+				name, value = strings.TrimSpace(v[:i]), strings.Trim(strings.TrimSpace(v[i+1:]), `"`)
+			}
+			cc[strings.ToLower(name)] = value
+		}
+	}
+	return cc
+}
+
+func cacheControlSeconds(cc map[string]string, name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// FilesystemCacheStorage is the CacheStorage that keeps the cached
+// responses in the file system, the files of a response are in
+//
+//	Dir/host/ab/abcdef.../
+//
+// where abcdef... is the fingerprint of the request, computed from
+// its method, canonical URL and body. The directory has the file
+// "meta" that is the JSON of the status code and headers, and the
+// file "response_body".
+type FilesystemCacheStorage struct {
+	// Dir specifies the root directory of the cached responses.
+	Dir string
+}
+
+type cacheMeta struct {
+	URL        string      `json:"url"`
+	Method     string      `json:"method"`
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Timestamp  time.Time   `json:"timestamp"`
+}
+
+func (s *FilesystemCacheStorage) path(req *http.Request) string {
+	fp := requestFingerprint(req)
+	host := strings.Replace(strings.ToLower(req.URL.Host), ":", "_", -1)
+	return filepath.Join(s.Dir, host, fp[:2], fp)
+}
+
+func (s *FilesystemCacheStorage) Retrieve(req *http.Request) (*http.Response, time.Time, error) {
+	dir := s.path(req)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "meta"))
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, nil
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+	var meta cacheMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, time.Time{}, err
+	}
+	body, err := ioutil.ReadFile(filepath.Join(dir, "response_body"))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if meta.Header == nil {
+		meta.Header = make(http.Header)
+	}
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", meta.StatusCode, http.StatusText(meta.StatusCode)),
+		StatusCode:    meta.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        meta.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	return resp, meta.Timestamp, nil
+}
+
+func (s *FilesystemCacheStorage) Store(req *http.Request, resp *http.Response, body []byte) error {
+	dir := s.path(req)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(&cacheMeta{
+		URL:        req.URL.String(),
+		Method:     req.Method,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Timestamp:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFileRename(filepath.Join(dir, "response_body"), body); err != nil {
+		return err
+	}
+	// The meta is written at last, a response without it is not cached.
+	return writeFileRename(filepath.Join(dir, "meta"), b)
+}
+
+// writeFileRename writes data to a temporary file and renames it to
+// the file name, the readers never see a partially written file. The
+// temporary file is unique, the same response may be stored at the
+// same time.
+func writeFileRename(name string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// requestFingerprint returns the hex SHA1 fingerprint of req, the
+// requests of the same method, canonical URL and body have the same
+// fingerprint.
+func requestFingerprint(req *http.Request) string {
+	method := req.Method
+	if method == "" {
+		method = "GET"
+	}
+	u := *req.URL
+	u.Host = strings.ToLower(u.Host)
+	if host, port, err := net.SplitHostPort(u.Host); err == nil &&
+		((u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443")) {
+		u.Host = host
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawQuery = u.Query().Encode()
+	u.Fragment = ""
+
+	h := sha1.New()
+	io.WriteString(h, method+" "+u.String()+"\n")
+	if req.GetBody != nil {
+		if r, err := req.GetBody(); err == nil {
+			io.Copy(h, r)
+			r.Close()
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type httpCacheHandler struct {
+	s       HttpCacheSettings
+	storage CacheStorage
+	policy  CachePolicy
+	next    HttpMessageHandler
+}
+
+func (h *httpCacheHandler) ignoreStatus(code int) bool {
+	if code == http.StatusNotModified {
+		// It is the response of the conditional request that sent by
+		// the Handler, there is nothing to cache.
+		return true
+	}
+	for _, v := range h.s.IgnoreStatusCodes {
+		if v == code {
+			return true
+		}
+	}
+	return false
+}
+
+// retrieve returns the cached response of req, or nil if it is not
+// cached or expired.
+func (h *httpCacheHandler) retrieve(req *http.Request) *http.Response {
+	cached, stored, err := h.storage.Retrieve(req)
+	if err != nil {
+		// The broken cache is ignored, it will be replaced.
+		return nil
+	}
+	if cached != nil && h.s.Expiration > 0 && time.Now().Sub(stored) > h.s.Expiration {
+		cached.Body.Close()
+		return nil
+	}
+	if cached != nil {
+		cached.Request = req
+	}
+	return cached
+}
+
+// isCached reports whether req is served by a fresh cached response
+// without sending it.
+func (h *httpCacheHandler) isCached(req *http.Request) bool {
+	if !h.policy.ShouldCacheRequest(req) {
+		return false
+	}
+	cached := h.retrieve(req)
+	if cached == nil {
+		return false
+	}
+	cached.Body.Close()
+	return h.policy.IsCachedResponseFresh(cached, req)
+}
+
+func (h *httpCacheHandler) Send(req *http.Request) (*http.Response, error) {
+	if !h.policy.ShouldCacheRequest(req) {
+		return h.next.Send(req)
+	}
+	cached := h.retrieve(req)
+
+	orig := req
+	if cached != nil {
+		if h.policy.IsCachedResponseFresh(cached, req) {
+			IncStat(req, "httpcache/hit", 1)
+			return cached, nil
+		}
+		req = conditionalRequest(req, cached.Header)
+	}
+
+	resp, err := h.next.Send(req)
+	if err != nil {
+		return resp, err
+	}
+	if cached != nil && h.policy.IsCachedResponseValid(cached, resp, req) {
+		IncStat(req, "httpcache/revalidate", 1)
+		if resp.StatusCode == http.StatusNotModified {
+			// Updates the stored headers by the 304 response.
+			for k, v := range resp.Header {
+				cached.Header[k] = v
+			}
+			if body, err := ioutil.ReadAll(cached.Body); err == nil {
+				cached.Body = ioutil.NopCloser(bytes.NewReader(body))
+				h.storage.Store(orig, cached, body)
+			}
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return cached, nil
+	}
+
+	IncStat(req, "httpcache/miss", 1)
+	if h.ignoreStatus(resp.StatusCode) || !h.policy.ShouldCacheResponse(resp, req) {
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if resp.Header.Get("Date") == "" {
+		resp.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	if err := h.storage.Store(orig, resp, body); err == nil {
+		IncStat(req, "httpcache/store", 1)
+	}
+	return resp, nil
+}
+
+// conditionalRequest returns a copy of req that revalidates the cached
+// response by its headers h, the conditional headers of req are kept.
+func conditionalRequest(req *http.Request, h http.Header) *http.Request {
+	etag, lastModified := h.Get("ETag"), h.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return req
+	}
+	r := req.Clone(req.Context())
+	if etag != "" && r.Header.Get("If-None-Match") == "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" && r.Header.Get("If-Modified-Since") == "" {
+		r.Header.Set("If-Modified-Since", lastModified)
+	}
+	return r
+}
+
+// HttpCacheMiddleware is a middleware that caches the HTTP responses,
+// the requests are served from the cache if their responses are cached
+// and can be used by the CachePolicy of s. The responses are stored in
+// the file system by default, see FilesystemCacheStorage. The Crawler
+// serves the fresh cached responses without waiting for the download
+// delay of the website.
+func HttpCacheMiddleware(s HttpCacheSettings) Middleware {
+	return func(next HttpMessageHandler) HttpMessageHandler {
+		h := &httpCacheHandler{s: s, storage: s.Storage, policy: s.Policy, next: next}
+		if h.storage == nil {
+			dir := s.Dir
+			if dir == "" {
+				dir = "httpcache"
+			}
+			h.storage = &FilesystemCacheStorage{Dir: dir}
+		}
+		if h.policy == nil {
+			h.policy = DummyCachePolicy{}
+		}
+		return h
+	}
+}
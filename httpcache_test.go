@@ -0,0 +1,246 @@
+package antch
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHttpCacheDummyPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "antch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hits := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		switch r.URL.Path {
+		case "/error":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write([]byte("hello " + r.URL.RawQuery))
+		}
+	}))
+	defer ts.Close()
+
+	handler := HttpCacheMiddleware(HttpCacheSettings{
+		Dir:               dir,
+		IgnoreStatusCodes: []int{http.StatusServiceUnavailable},
+	})(defaultMessageHandler())
+	get := func(URL string) (int, string) {
+		req, _ := http.NewRequest("GET", URL, nil)
+		resp, err := handler.Send(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, body := get(ts.URL + "/?b=2&a=1"); body != "hello b=2&a=1" {
+			t.Errorf("expected body %q; got %q", "hello b=2&a=1", body)
+		}
+	}
+	// The same URL with the query in the other order.
+	get(ts.URL + "/?a=1&b=2")
+	if g, e := hits["/"], 1; g != e {
+		t.Errorf("/ expected %d requests; got %d", e, g)
+	}
+
+	for i := 0; i < 2; i++ {
+		if code, _ := get(ts.URL + "/error"); code != http.StatusServiceUnavailable {
+			t.Errorf("expected status code %d; got %d", http.StatusServiceUnavailable, code)
+		}
+	}
+	if g, e := hits["/error"], 2; g != e {
+		t.Errorf("/error expected %d requests; got %d", e, g)
+	}
+
+	// The cache is expired.
+	handler = HttpCacheMiddleware(HttpCacheSettings{
+		Dir:        dir,
+		Expiration: time.Nanosecond,
+	})(defaultMessageHandler())
+	get(ts.URL + "/?a=1&b=2")
+	if g, e := hits["/"], 2; g != e {
+		t.Errorf("/ expected %d requests; got %d", e, g)
+	}
+}
+
+func TestHttpCacheRFC7234Policy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "antch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hits, notModified := make(map[string]int), 0
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/etag":
+			if fail {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Cache-Control", "no-cache")
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/no-store":
+			w.Header().Set("Cache-Control", "max-age=60, no-store")
+		case "/no-validator":
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	handler := HttpCacheMiddleware(HttpCacheSettings{
+		Dir:    dir,
+		Policy: RFC7234CachePolicy{},
+	})(defaultMessageHandler())
+	get := func(path string, header ...string) (int, string) {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := handler.Send(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	for _, path := range []string{"/fresh", "/etag", "/no-store", "/no-validator"} {
+		for i := 0; i < 3; i++ {
+			if code, body := get(path); code != http.StatusOK || body != path {
+				t.Errorf("%s expected 200 %q; got %d %q", path, path, code, body)
+			}
+		}
+	}
+	for path, want := range map[string]int{"/fresh": 1, "/etag": 3, "/no-store": 3, "/no-validator": 3} {
+		if g := hits[path]; g != want {
+			t.Errorf("%s expected %d requests; got %d", path, want, g)
+		}
+	}
+	if g, e := notModified, 2; g != e {
+		t.Errorf("expected %d not modified responses; got %d", e, g)
+	}
+
+	// The request asks for a fresh response.
+	get("/fresh", "Cache-Control", "no-cache")
+	if g, e := hits["/fresh"], 2; g != e {
+		t.Errorf("/fresh expected %d requests; got %d", e, g)
+	}
+
+	// The stale response is used if the server is failed.
+	fail = true
+	if code, body := get("/etag"); code != http.StatusOK || body != "/etag" {
+		t.Errorf("expected 200 %q; got %d %q", "/etag", code, body)
+	}
+}
+
+func TestRFC7234CachePolicyFresh(t *testing.T) {
+	now := time.Now().UTC()
+	date := now.Add(-time.Hour).Format(http.TimeFormat)
+	var p RFC7234CachePolicy
+	for i, test := range []struct {
+		header, reqHeader map[string]string
+		fresh             bool
+	}{
+		{map[string]string{"Cache-Control": "max-age=7200"}, nil, true},
+		{map[string]string{"Cache-Control": "max-age=60"}, nil, false},
+		{map[string]string{"Cache-Control": "max-age=7200"}, map[string]string{"Cache-Control": "max-age=60"}, false},
+		{map[string]string{"Cache-Control": "max-age=60"}, map[string]string{"Cache-Control": "max-stale"}, true},
+		{map[string]string{"Cache-Control": "max-age=60, must-revalidate"}, map[string]string{"Cache-Control": "max-stale"}, false},
+		{map[string]string{"Cache-Control": "max-age=7200", "Age": "7200"}, nil, false},
+		{map[string]string{"Expires": now.Add(time.Hour).Format(http.TimeFormat)}, nil, true},
+		{map[string]string{"Expires": "0"}, nil, false},
+		// Heuristic freshness is 10% of the time since Last-Modified.
+		{map[string]string{"Last-Modified": now.Add(-20 * 24 * time.Hour).Format(http.TimeFormat)}, nil, true},
+		{map[string]string{"Last-Modified": now.Add(-2 * time.Hour).Format(http.TimeFormat)}, nil, false},
+	} {
+		cached := &http.Response{Header: http.Header{"Date": {date}}}
+		for k, v := range test.header {
+			cached.Header.Set(k, v)
+		}
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		for k, v := range test.reqHeader {
+			req.Header.Set(k, v)
+		}
+		if g := p.IsCachedResponseFresh(cached, req); g != test.fresh {
+			t.Errorf("%d: expected fresh %v; got %v", i, test.fresh, g)
+		}
+	}
+}
+
+func TestCrawlerHttpCacheHit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "antch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	URLs := []string{ts.URL + "/a", ts.URL + "/b", ts.URL + "/c"}
+	crawl := func(delay time.Duration) time.Duration {
+		tc := NewCrawler().UseMiddleware(HttpCacheMiddleware(HttpCacheSettings{Dir: dir}))
+		tc.DownloadDelay = delay
+		tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {}))
+		start := time.Now()
+		tc.StartURLs(URLs)
+		if err := tc.Run(context.Background()); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		return time.Now().Sub(start)
+	}
+	crawl(time.Millisecond)
+
+	// The cached responses are served without the download delay.
+	if d := crawl(200 * time.Millisecond); d >= 200*time.Millisecond {
+		t.Errorf("expected the cached responses are served in 200ms; got %v", d)
+	}
+	if g, e := atomic.LoadInt32(&hits), int32(len(URLs)); g != e {
+		t.Errorf("expected %d requests; got %d", e, g)
+	}
+
+	// Only the files of the responses are left.
+	var files []string
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			files = append(files, fi.Name())
+		}
+		return nil
+	})
+	sort.Strings(files)
+	if g, e := strings.Join(files, " "), "meta meta meta response_body response_body response_body"; g != e {
+		t.Errorf("expected the cached files %s; got %s", e, g)
+	}
+}
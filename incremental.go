@@ -0,0 +1,232 @@
+package antch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Validators is the cache validators of a URL, which are sent as the
+// If-None-Match and If-Modified-Since headers of the next request.
+type Validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// ValidatorStore keeps the Validators of the visited URLs in a local
+// file, to recrawl the URLs with conditional requests.
+type ValidatorStore struct {
+	mu   sync.Mutex
+	m    map[string]Validators
+	file *os.File
+}
+
+type validatorRecord struct {
+	URL string `json:"url"`
+	Validators
+}
+
+// OpenValidatorStore opens the ValidatorStore of the file path, the
+// file is created if not exists. If path is empty, the Validators are
+// kept in memory only.
+func OpenValidatorStore(path string) (*ValidatorStore, error) {
+	s := &ValidatorStore{m: make(map[string]Validators)}
+	if path == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var r validatorRecord
+			if err := json.Unmarshal(scanner.Bytes(), &r); err == nil {
+				s.set(r.URL, r.Validators)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Rewrites the file with the latest Validators of each URL, the
+	// updates are appended to it.
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for URL, v := range s.m {
+		enc.Encode(&validatorRecord{URL: URL, Validators: v})
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if s.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ValidatorStore) set(URL string, v Validators) {
+	if v == (Validators{}) {
+		delete(s.m, URL)
+	} else {
+		s.m[URL] = v
+	}
+}
+
+// Get returns the Validators of the URL.
+func (s *ValidatorStore) Get(URL string) (Validators, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.m[URL]
+	return v, ok
+}
+
+// Set sets the Validators of the URL, the URL is removed if v is empty.
+// The store is not changed if it failed to write the file.
+func (s *ValidatorStore) Set(URL string, v Validators) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.m[URL]; (ok && old == v) || (!ok && v == (Validators{})) {
+		return nil
+	}
+	if s.file != nil {
+		b, err := json.Marshal(&validatorRecord{URL: URL, Validators: v})
+		if err != nil {
+			return err
+		}
+		if _, err := s.file.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	// The Validators are kept only if they have been written, as
+	// they will be after restart.
+	s.set(URL, v)
+	return nil
+}
+
+// Len returns the number of URLs in the store.
+func (s *ValidatorStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.m)
+}
+
+// Close closes the file of the store.
+func (s *ValidatorStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+type conditionalKey struct{}
+
+// NotModified reports whether resp is the 304 Not Modified response
+// of the conditional request sent by IncrementalMiddleware, that is
+// the page has not changed since the last crawl.
+func NotModified(resp *http.Response) bool {
+	if resp == nil || resp.StatusCode != http.StatusNotModified || resp.Request == nil {
+		return false
+	}
+	v, _ := resp.Request.Context().Value(conditionalKey{}).(bool)
+	return v
+}
+
+type incrementalHandler struct {
+	store *ValidatorStore
+	next  HttpMessageHandler
+}
+
+func (h *incrementalHandler) Send(req *http.Request) (*http.Response, error) {
+	if req.Method != "" && req.Method != "GET" {
+		return h.next.Send(req)
+	}
+	u := *req.URL
+	u.Fragment = ""
+	URL := u.String()
+
+	conditional := false
+	if v, ok := h.store.Get(URL); ok && req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == "" {
+		conditional = true
+		req = req.Clone(context.WithValue(req.Context(), conditionalKey{}, true))
+		if v.ETag != "" {
+			req.Header.Set("If-None-Match", v.ETag)
+		}
+		if v.LastModified != "" {
+			req.Header.Set("If-Modified-Since", v.LastModified)
+		}
+	}
+	resp, err := h.next.Send(req)
+	if err != nil {
+		return resp, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		// The 304 of the request that has the conditional headers
+		// already is not counted, see NotModified.
+		if conditional {
+			IncStat(req, "incremental/not_modified", 1)
+		}
+		if resp.Request == nil {
+			resp.Request = req
+		}
+	case resp.StatusCode == http.StatusOK:
+		err := h.store.Set(URL, Validators{
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		})
+		if err != nil {
+			// The URL is crawled without the Validators next time.
+			IncStat(req, "incremental/store_errors", 1)
+		}
+	}
+	return resp, nil
+}
+
+// Close closes the ValidatorStore.
+func (h *incrementalHandler) Close() error {
+	return h.store.Close()
+}
+
+// IncrementalMiddleware is a middleware for the incremental recrawl,
+// it keeps the ETag and Last-Modified of the 200 responses in the
+// store, and sends the GET requests of the same URLs with the
+// If-None-Match and If-Modified-Since headers in the next crawl. The
+// requests that have the conditional headers already are not changed.
+//
+// The 304 Not Modified responses of the conditional requests are served
+// by the Crawler's NotModifiedHandler, or skipped. See NotModified.
+// The store is closed when the Crawler is shut down.
+func IncrementalMiddleware(store *ValidatorStore) Middleware {
+	return func(next HttpMessageHandler) HttpMessageHandler {
+		return &incrementalHandler{store: store, next: next}
+	}
+}
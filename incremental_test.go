@@ -0,0 +1,228 @@
+package antch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidatorStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "antch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "validators")
+
+	s, err := OpenValidatorStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("http://example.com/a", Validators{ETag: `"a1"`})
+	s.Set("http://example.com/a", Validators{ETag: `"a2"`})
+	s.Set("http://example.com/b", Validators{LastModified: "Mon, 02 Jan 2006 15:04:05 GMT"})
+	s.Set("http://example.com/c", Validators{ETag: `"c"`})
+	s.Set("http://example.com/c", Validators{})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenValidatorStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if g, e := s.Len(), 2; g != e {
+		t.Errorf("expected %d URLs; got %d", e, g)
+	}
+	if v, _ := s.Get("http://example.com/a"); v.ETag != `"a2"` {
+		t.Errorf("expected ETag %q; got %q", `"a2"`, v.ETag)
+	}
+	if _, ok := s.Get("http://example.com/c"); ok {
+		t.Errorf("expected http://example.com/c is removed")
+	}
+	// The file is compacted when opened.
+	b, _ := ioutil.ReadFile(path)
+	if g, e := strings.Count(string(b), "\n"), 2; g != e {
+		t.Errorf("expected %d lines; got %d", e, g)
+	}
+}
+
+func TestCrawlerIncremental(t *testing.T) {
+	dir, err := ioutil.TempDir("", "antch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "validators")
+
+	version := 1
+	lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/etag":
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/last-modified":
+			w.Header().Set("Last-Modified", lastModified)
+			if r.Header.Get("If-Modified-Since") == lastModified {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/changed":
+			etag := fmt.Sprintf(`"v%d"`, version)
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	crawl := func(notModified bool) (served, skipped []string) {
+		store, err := OpenValidatorStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mu sync.Mutex
+		tc := NewCrawler()
+		tc.DownloadDelay = time.Millisecond
+		tc.UseMiddleware(IncrementalMiddleware(store))
+		tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+			mu.Lock()
+			defer mu.Unlock()
+			served = append(served, resp.Request.URL.Path)
+		}))
+		if notModified {
+			tc.NotModifiedHandler = HandlerFunc(func(c chan<- Item, resp *http.Response) {
+				mu.Lock()
+				defer mu.Unlock()
+				skipped = append(skipped, resp.Request.URL.Path)
+			})
+		}
+		tc.StartURLs([]string{ts.URL + "/etag", ts.URL + "/last-modified", ts.URL + "/changed", ts.URL + "/none"})
+		if err := tc.Run(context.Background()); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		sort.Strings(served)
+		sort.Strings(skipped)
+		return
+	}
+
+	served, _ := crawl(true)
+	if g, e := fmt.Sprint(served), "[/changed /etag /last-modified /none]"; g != e {
+		t.Errorf("first crawl expected %s; got %s", e, g)
+	}
+
+	version = 2
+	served, skipped := crawl(true)
+	if g, e := fmt.Sprint(served), "[/changed /none]"; g != e {
+		t.Errorf("second crawl expected %s; got %s", e, g)
+	}
+	if g, e := fmt.Sprint(skipped), "[/etag /last-modified]"; g != e {
+		t.Errorf("second crawl expected not modified %s; got %s", e, g)
+	}
+
+	// The not modified responses are skipped without NotModifiedHandler.
+	served, _ = crawl(false)
+	if g, e := fmt.Sprint(served), "[/none]"; g != e {
+		t.Errorf("third crawl expected %s; got %s", e, g)
+	}
+}
+
+func TestCrawlerIncrementalStoreError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "antch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "validators")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	store, err := OpenValidatorStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The writes to the store fail.
+	store.file.Close()
+	if store.file, err = os.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.UseMiddleware(IncrementalMiddleware(store))
+	tc.StartURLs([]string{ts.URL + "/a"})
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if g, e := tc.Stats()[""]["incremental/store_errors"], int64(1); g != e {
+		t.Errorf("expected %d store errors; got %d", e, g)
+	}
+	if _, ok := store.Get(ts.URL + "/a"); ok {
+		t.Error("expected the Validators are not kept after the write failed")
+	}
+}
+
+func TestCrawlerIncrementalConditional(t *testing.T) {
+	dir, err := ioutil.TempDir("", "antch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+	}))
+	defer ts.Close()
+
+	store, err := OpenValidatorStore(filepath.Join(dir, "validators"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int32
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.UseMiddleware(IncrementalMiddleware(store))
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		atomic.AddInt32(&n, 1)
+	}))
+	// The request has the conditional headers already.
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	if err := tc.Crawl(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if g := atomic.LoadInt32(&n); g != 1 {
+		t.Errorf("expected the 304 response is served by the Handler; got %d", g)
+	}
+	if g := tc.Stats()[""]["incremental/not_modified"]; g != 0 {
+		t.Errorf("expected no not modified responses counted; got %d", g)
+	}
+}
@@ -0,0 +1,286 @@
+package antch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/antchfx/htmlquery"
+	"golang.org/x/net/html"
+)
+
+// Link is a link extracted from the HTML document.
+type Link struct {
+	// URL is the absolute URL of the link, without fragment.
+	URL *url.URL
+	// Text is the text of the link element.
+	Text string
+	// NoFollow reports whether the link has rel="nofollow", or the
+	// document has a robots meta tag with nofollow.
+	NoFollow bool
+}
+
+// LinkExtractor extracts links from the HTML documents.
+type LinkExtractor struct {
+	// Allow specifies regular expressions that the URL of the link
+	// must match any of them.
+	// If empty, all links are allowed.
+	Allow []*regexp.Regexp
+
+	// Deny specifies regular expressions that the URL of the link
+	// must not match any of them. It takes precedence over Allow.
+	Deny []*regexp.Regexp
+
+	// AllowedDomains specifies the domains of the links, includes
+	// their subdomains.
+	// If empty, links to all domains are allowed.
+	AllowedDomains []string
+
+	// RestrictXPaths specifies XPath expressions of the regions in
+	// the document that the links are extracted from.
+	// If empty, the whole document is used.
+	RestrictXPaths []string
+
+	// Tags specifies the tag names to extract links from.
+	// Default is a, area.
+	Tags []string
+
+	// Attrs specifies the attribute names of tags to extract links from.
+	// Default is href.
+	Attrs []string
+
+	// IncludeNoFollow specifies the links with nofollow are extracted.
+	IncludeNoFollow bool
+}
+
+var (
+	defaultLinkTags  = []string{"a", "area"}
+	defaultLinkAttrs = []string{"href"}
+)
+
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (le *LinkExtractor) allowed(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	if len(le.AllowedDomains) > 0 && !matchDomains(u.Hostname(), le.AllowedDomains) {
+		return false
+	}
+	s := u.String()
+	for _, re := range le.Deny {
+		if re.MatchString(s) {
+			return false
+		}
+	}
+	if len(le.Allow) == 0 {
+		return true
+	}
+	for _, re := range le.Allow {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// baseURL returns the URL of <base href> in the document if it has.
+func baseURL(doc *html.Node, base *url.URL) *url.URL {
+	if n := htmlquery.FindOne(doc, "//head/base[@href]"); n != nil {
+		if u, err := base.Parse(htmlquery.SelectAttr(n, "href")); err == nil {
+			return u
+		}
+	}
+	return base
+}
+
+// metaNoFollow reports whether the document has a robots meta tag
+// with nofollow.
+func metaNoFollow(doc *html.Node) bool {
+	for _, n := range htmlquery.Find(doc, "//meta[@name]") {
+		if strings.EqualFold(htmlquery.SelectAttr(n, "name"), "robots") &&
+			strings.Contains(strings.ToLower(htmlquery.SelectAttr(n, "content")), "nofollow") {
+			return true
+		}
+	}
+	return false
+}
+
+// Extract returns the links of the HTML document doc, the relative
+// URLs are resolved by the base URL, or the <base href> of the document.
+func (le *LinkExtractor) Extract(doc *html.Node, base *url.URL) []Link {
+	tags, attrs := le.Tags, le.Attrs
+	if len(tags) == 0 {
+		tags = defaultLinkTags
+	}
+	if len(attrs) == 0 {
+		attrs = defaultLinkAttrs
+	}
+	base = baseURL(doc, base)
+	nofollow := metaNoFollow(doc)
+
+	regions := []*html.Node{doc}
+	if len(le.RestrictXPaths) > 0 {
+		regions = nil
+		for _, expr := range le.RestrictXPaths {
+			regions = append(regions, htmlquery.Find(doc, expr)...)
+		}
+	}
+
+	var (
+		links []Link
+		seen  = make(map[string]bool)
+	)
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && containsString(tags, n.Data) {
+			for _, attr := range n.Attr {
+				if !containsString(attrs, attr.Key) {
+					continue
+				}
+				u, err := base.Parse(strings.TrimSpace(attr.Val))
+				if err != nil {
+					continue
+				}
+				u.Fragment = ""
+				if !le.allowed(u) || seen[u.String()] {
+					continue
+				}
+				link := Link{
+					URL:      u,
+					Text:     strings.TrimSpace(htmlquery.InnerText(n)),
+					NoFollow: nofollow,
+				}
+				for _, v := range strings.Fields(htmlquery.SelectAttr(n, "rel")) {
+					if strings.EqualFold(v, "nofollow") {
+						link.NoFollow = true
+					}
+				}
+				if link.NoFollow && !le.IncludeNoFollow {
+					continue
+				}
+				seen[u.String()] = true
+				links = append(links, link)
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	for _, n := range regions {
+		walk(n)
+	}
+	return links
+}
+
+// CrawlRule defines how the CrawlSpider follows the links.
+type CrawlRule struct {
+	// LinkExtractor specifies how to extract links from the pages.
+	LinkExtractor *LinkExtractor
+
+	// Handler specifies a Handler to serve the responses of the links
+	// extracted by the rule.
+	Handler Handler
+
+	// Follow specifies whether the links in the responses of the rule
+	// should be followed by the rules. The links are always followed
+	// if Handler is nil.
+	Follow bool
+}
+
+// CrawlSpider is a Handler that follows the links extracted from the
+// HTML pages by its rules, and dispatches the responses of the links to
+// the Handler of the rule. A link extracted by many rules is used by
+// the first rule.
+//
+// The responses served by CrawlSpider itself are the start pages,
+// the links in them are followed by the rules. Each of links is
+// followed once by the CrawlSpider, so a dupe filter is not required.
+type CrawlSpider struct {
+	Rules []CrawlRule
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// ServeSpider performs follow the links in the start page.
+func (s *CrawlSpider) ServeSpider(c chan<- Item, resp *http.Response) {
+	s.visit(resp.Request.URL.String())
+	s.follow(c, resp)
+}
+
+// visit reports whether the URL is not followed yet, and marks it
+// as followed.
+func (s *CrawlSpider) visit(URL string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	if s.seen[URL] {
+		return false
+	}
+	s.seen[URL] = true
+	return true
+}
+
+// follow extracts links from resp and crawls them by the rules.
+func (s *CrawlSpider) follow(c chan<- Item, resp *http.Response) {
+	doc, err := ParseHTML(resp)
+	if err != nil {
+		return
+	}
+	for i, rule := range s.Rules {
+		for _, link := range rule.LinkExtractor.Extract(doc, resp.Request.URL) {
+			URL := link.URL.String()
+			if !s.visit(URL) {
+				continue
+			}
+			req, err := http.NewRequest("GET", URL, nil)
+			if err != nil {
+				continue
+			}
+			c <- WithHandler(req, &crawlRuleHandler{spider: s, rule: i})
+		}
+	}
+}
+
+// crawlRuleHandler serves the responses of the links extracted
+// by a rule of CrawlSpider.
+type crawlRuleHandler struct {
+	spider *CrawlSpider
+	rule   int
+}
+
+func (h *crawlRuleHandler) ServeSpider(c chan<- Item, resp *http.Response) {
+	rule := h.spider.Rules[h.rule]
+	if rule.Handler == nil {
+		h.spider.follow(c, resp)
+		return
+	}
+	if !rule.Follow {
+		rule.Handler.ServeSpider(c, resp)
+		return
+	}
+
+	// The response body is used by both Handler and follow.
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	rule.Handler.ServeSpider(c, resp)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	h.spider.follow(c, resp)
+}
@@ -0,0 +1,179 @@
+package antch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antchfx/htmlquery"
+)
+
+func TestLinkExtractor(t *testing.T) {
+	const s = `<html><head><base href="http://example.com/dir/"></head><body>
+<div id="nav">
+	<a href="page?id=1">Page 1</a>
+	<a href="/page?id=2#top">Page 2</a>
+	<a href="page?id=1">Page 1 again</a>
+	<a href="http://www.example.com/other">Other</a>
+	<a href="http://example.org/">Offsite</a>
+	<a href="mailto:me@example.com">Mail</a>
+	<a href="/private/x">Private</a>
+	<a href="/page?id=3" rel="external nofollow">No follow</a>
+	<map><area href="/area"></map>
+</div>
+<div id="footer"><a href="/footer">Footer</a></div>
+</body></html>`
+	doc, err := htmlquery.Parse(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := url.Parse("http://example.com/")
+
+	var linkTests = []struct {
+		le   *LinkExtractor
+		want []string
+	}{
+		{
+			&LinkExtractor{},
+			[]string{
+				"http://example.com/dir/page?id=1",
+				"http://example.com/page?id=2",
+				"http://www.example.com/other",
+				"http://example.org/",
+				"http://example.com/private/x",
+				"http://example.com/area",
+				"http://example.com/footer",
+			},
+		},
+		{
+			&LinkExtractor{
+				AllowedDomains: []string{"example.com"},
+				Deny:           []*regexp.Regexp{regexp.MustCompile(`/private/`)},
+				RestrictXPaths: []string{`//div[@id="nav"]`},
+			},
+			[]string{
+				"http://example.com/dir/page?id=1",
+				"http://example.com/page?id=2",
+				"http://www.example.com/other",
+				"http://example.com/area",
+			},
+		},
+		{
+			&LinkExtractor{
+				Allow:           []*regexp.Regexp{regexp.MustCompile(`/page\?`)},
+				Tags:            []string{"a"},
+				IncludeNoFollow: true,
+			},
+			[]string{
+				"http://example.com/dir/page?id=1",
+				"http://example.com/page?id=2",
+				"http://example.com/page?id=3",
+			},
+		},
+	}
+	for i, test := range linkTests {
+		var got []string
+		for _, link := range test.le.Extract(doc, base) {
+			got = append(got, link.URL.String())
+		}
+		if g, e := fmt.Sprint(got), fmt.Sprint(test.want); g != e {
+			t.Errorf("%d: expected %s; got %s", i, e, g)
+		}
+	}
+}
+
+func TestLinkExtractorMetaNoFollow(t *testing.T) {
+	const s = `<html><head><meta name="ROBOTS" content="noindex, nofollow"></head>
+<body><a href="/a">A</a></body></html>`
+	doc, err := htmlquery.Parse(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := url.Parse("http://example.com/")
+
+	if links := (&LinkExtractor{}).Extract(doc, base); len(links) != 0 {
+		t.Errorf("expected no links; got %d", len(links))
+	}
+	links := (&LinkExtractor{IncludeNoFollow: true}).Extract(doc, base)
+	if len(links) != 1 || !links[0].NoFollow || links[0].Text != "A" {
+		t.Errorf("expected a nofollow link; got %v", links)
+	}
+}
+
+func TestCrawlSpider(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		items []string
+		hits  = make(map[string]int)
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.String()]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<a href="/list?page=1">List</a><a href="/about">About</a>`)
+		case "/list":
+			if r.URL.Query().Get("page") == "1" {
+				fmt.Fprint(w, `<a href="/item/1">1</a><a href="/item/2">2</a><a href="/list?page=2">Next</a>`)
+			} else {
+				fmt.Fprint(w, `<a href="/item/2">2</a><a href="/item/3">3</a>`)
+			}
+		default:
+			fmt.Fprintf(w, `<h1>%s</h1><a href="/list?page=9">Related</a>`, r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.UsePipeline(func(_ PipelineHandler) PipelineHandler {
+		return PipelineHandlerFunc(func(v Item) {
+			mu.Lock()
+			items = append(items, v.(string))
+			mu.Unlock()
+		})
+	})
+	tc.Handle("*", &CrawlSpider{
+		Rules: []CrawlRule{
+			{
+				LinkExtractor: &LinkExtractor{Allow: []*regexp.Regexp{regexp.MustCompile(`/item/`)}},
+				Handler: HandlerFunc(func(c chan<- Item, resp *http.Response) {
+					doc, err := ParseHTML(resp)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					c <- htmlquery.InnerText(htmlquery.FindOne(doc, "//h1"))
+				}),
+			},
+			{
+				LinkExtractor: &LinkExtractor{Allow: []*regexp.Regexp{regexp.MustCompile(`/list\?`)}},
+			},
+		},
+	})
+	tc.StartURLs([]string{ts.URL + "/"})
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	want := []string{"/item/1", "/item/2", "/item/3"}
+	sort.Strings(items)
+	if g, e := fmt.Sprint(items), fmt.Sprint(want); g != e {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	// The links in many pages are followed once.
+	for URL, n := range hits {
+		if n != 1 {
+			t.Errorf("%s expected 1 request; got %d", URL, n)
+		}
+	}
+}
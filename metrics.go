@@ -0,0 +1,231 @@
+package antch
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets is the upper bounds of the download latency
+// histogram in seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type histogram struct {
+	counts []uint64 // counts of each bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metrics keeps the values of the Crawler that not in Stats.
+type metrics struct {
+	// pipeline is the number of items that waiting or being
+	// processed in the pipeline.
+	pipeline int64
+
+	mu      sync.Mutex
+	latency map[string]*histogram
+}
+
+func (m *metrics) observeLatency(u *url.URL, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.latency == nil {
+		m.latency = make(map[string]*histogram)
+	}
+	site := u.Hostname()
+	h := m.latency[site]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[site] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *metrics) addPipeline(delta int64) {
+	atomic.AddInt64(&m.pipeline, delta)
+}
+
+// MetricsHandler returns an http.Handler that exposes the metrics of
+// the Crawler in the Prometheus text format, it can be mounted on any
+// ServeMux such as:
+//
+//	http.Handle("/metrics", crawler.MetricsHandler())
+//
+// The metrics are:
+//
+//	antch_requests_in_flight{site}             gauge, the requests being downloaded
+//	antch_requests_total{site}                 counter, the requests sent
+//	antch_requests_failed_total{site}          counter, the requests failed with errors
+//	antch_responses_total{site,code}           counter, the responses by HTTP status code
+//	antch_response_bytes_total{site}           counter, the bytes of response bodies read
+//	antch_download_duration_seconds{site}      histogram, the latency of downloads
+//	antch_items_total                          counter, the items written into the pipeline
+//	antch_pipeline_items                       gauge, the items waiting or being processed
+//	antch_scheduler_requests                   gauge, the requests in the Scheduler
+//	antch_spiders                              gauge, the live per-site spiders
+//
+// The counters of Stats are not available if StatsCollector does
+// not support Snapshot. The handler does not start the Crawler, the
+// metrics are empty until the Crawler is started.
+func (c *Crawler) MetricsHandler() http.Handler {
+	return c.metricsHandler()
+}
+
+func (c *Crawler) metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		c.writeMetrics(bw)
+		bw.Flush()
+	})
+}
+
+func (c *Crawler) writeMetrics(w *bufio.Writer) {
+	var (
+		stats     map[string]map[string]int64
+		scheduled int
+	)
+	if c.started() {
+		stats = c.stats.Snapshot()
+		scheduled = c.scheduler.Len()
+	}
+	var sites []string
+	for site := range stats {
+		if site != "" {
+			sites = append(sites, site)
+		}
+	}
+	sort.Strings(sites)
+
+	// The in-flight requests of spiders, the spiders of the same
+	// host with different schemes are summed.
+	inflight := make(map[string]int)
+	c.spiderMu.Lock()
+	spiders := len(c.spider)
+	for _, s := range c.spider {
+		s.mu.Lock()
+		inflight[s.host] += s.active
+		s.mu.Unlock()
+	}
+	c.spiderMu.Unlock()
+
+	writeHeader(w, "antch_requests_in_flight", "gauge", "The number of HTTP requests being downloaded.")
+	for _, site := range sortedKeys(inflight) {
+		writeSample(w, "antch_requests_in_flight", fmt.Sprint(inflight[site]), "site", site)
+	}
+
+	for _, m := range []struct{ name, key, help string }{
+		{"antch_requests_total", "requests/sent", "The number of HTTP requests sent."},
+		{"antch_requests_failed_total", "requests/failed", "The number of HTTP requests failed with errors."},
+		{"antch_response_bytes_total", "responses/bytes", "The number of bytes of response bodies read."},
+	} {
+		writeHeader(w, m.name, "counter", m.help)
+		for _, site := range sites {
+			if v, ok := stats[site][m.key]; ok {
+				writeSample(w, m.name, fmt.Sprint(v), "site", site)
+			}
+		}
+	}
+
+	const statusPrefix = "responses/status/"
+	writeHeader(w, "antch_responses_total", "counter", "The number of HTTP responses by status code.")
+	for _, site := range sites {
+		var codes []string
+		for key := range stats[site] {
+			if strings.HasPrefix(key, statusPrefix) {
+				codes = append(codes, key[len(statusPrefix):])
+			}
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			writeSample(w, "antch_responses_total", fmt.Sprint(stats[site][statusPrefix+code]), "site", site, "code", code)
+		}
+	}
+
+	writeHeader(w, "antch_download_duration_seconds", "histogram", "The latency of HTTP downloads in seconds.")
+	c.metrics.mu.Lock()
+	latencySites := make([]string, 0, len(c.metrics.latency))
+	for site := range c.metrics.latency {
+		latencySites = append(latencySites, site)
+	}
+	sort.Strings(latencySites)
+	for _, site := range latencySites {
+		h := c.metrics.latency[site]
+		var n uint64
+		for i, le := range latencyBuckets {
+			n += h.counts[i]
+			writeSample(w, "antch_download_duration_seconds_bucket", fmt.Sprint(n), "site", site, "le", formatFloat(le))
+		}
+		writeSample(w, "antch_download_duration_seconds_bucket", fmt.Sprint(h.count), "site", site, "le", "+Inf")
+		writeSample(w, "antch_download_duration_seconds_sum", formatFloat(h.sum), "site", site)
+		writeSample(w, "antch_download_duration_seconds_count", fmt.Sprint(h.count), "site", site)
+	}
+	c.metrics.mu.Unlock()
+
+	writeHeader(w, "antch_items_total", "counter", "The number of items written into the pipeline.")
+	if stats != nil {
+		writeSample(w, "antch_items_total", fmt.Sprint(stats[""]["items"]))
+	}
+	writeHeader(w, "antch_pipeline_items", "gauge", "The number of items waiting or being processed in the pipeline.")
+	writeSample(w, "antch_pipeline_items", fmt.Sprint(atomic.LoadInt64(&c.metrics.pipeline)))
+	writeHeader(w, "antch_scheduler_requests", "gauge", "The number of requests in the Scheduler.")
+	writeSample(w, "antch_scheduler_requests", fmt.Sprint(scheduled))
+	writeHeader(w, "antch_spiders", "gauge", "The number of live per-site spiders.")
+	writeSample(w, "antch_spiders", fmt.Sprint(spiders))
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeSample writes a sample with the label pairs.
+func writeSample(w *bufio.Writer, name, value string, labels ...string) {
+	w.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			w.WriteByte('{')
+		} else {
+			w.WriteByte(',')
+		}
+		fmt.Fprintf(w, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		if i+2 >= len(labels) {
+			w.WriteByte('}')
+		}
+	}
+	w.WriteByte(' ')
+	w.WriteString(value)
+	w.WriteByte('\n')
+}
@@ -0,0 +1,97 @@
+package antch
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- true
+			<-release
+		}
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.MaxConcurrentRequestsPerSite = 2
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		c <- resp.Request.URL.Path
+	}))
+	h := tc.MetricsHandler()
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		if g, e := rec.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8"; g != e {
+			t.Errorf("Content-Type expected %s; got %s", e, g)
+		}
+		return rec.Body.String()
+	}
+	contains := func(s string, lines ...string) {
+		for _, line := range lines {
+			if !strings.Contains(s, "\n"+line+"\n") {
+				t.Errorf("expected metrics contains %q; got\n%s", line, s)
+			}
+		}
+	}
+
+	// The metrics are empty before the Crawler is started, the
+	// handler does not start it.
+	contains(scrape(), `antch_scheduler_requests 0`, `antch_spiders 0`)
+	if tc.started() {
+		t.Fatal("expected the Crawler is not started by the handler")
+	}
+
+	tc.StartURLs([]string{ts.URL + "/slow", ts.URL + "/missing", ts.URL + "/"})
+	<-started
+	// Waits for other requests are finished.
+	for i := 0; i < 100 && !strings.Contains(scrape(), `antch_requests_total{site="127.0.0.1"} 3`); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	contains(scrape(),
+		`antch_requests_in_flight{site="127.0.0.1"} 1`,
+		`antch_spiders 1`,
+		`antch_scheduler_requests 0`,
+	)
+
+	close(release)
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	s := scrape()
+	contains(s,
+		"# TYPE antch_responses_total counter",
+		`antch_requests_total{site="127.0.0.1"} 3`,
+		`antch_responses_total{site="127.0.0.1",code="200"} 2`,
+		`antch_responses_total{site="127.0.0.1",code="404"} 1`,
+		`antch_download_duration_seconds_bucket{site="127.0.0.1",le="+Inf"} 3`,
+		`antch_download_duration_seconds_count{site="127.0.0.1"} 3`,
+		`antch_items_total 3`,
+		`antch_pipeline_items 0`,
+	)
+	if !strings.Contains(s, `antch_download_duration_seconds_bucket{site="127.0.0.1",le="0.005"} `) {
+		t.Errorf("expected histogram buckets; got\n%s", s)
+	}
+}
+
+func TestWriteSampleEscape(t *testing.T) {
+	var b strings.Builder
+	w := bufio.NewWriter(&b)
+	writeSample(w, "m", "1", "site", "a\"b\\c\n")
+	w.Flush()
+	if g, e := b.String(), "m{site=\"a\\\"b\\\\c\\n\"} 1\n"; g != e {
+		t.Errorf("expected %q; got %q", e, g)
+	}
+}
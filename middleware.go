@@ -1,9 +1,15 @@
 package antch
 
 import (
+	"errors"
 	"net/http"
 )
 
+// ErrDuplicate is the error of requests that denied by the dupe
+// filter middlewares since they have been visited before. Use
+// errors.Is to check the error.
+var ErrDuplicate = errors.New("duplicate request")
+
 // HttpMessageHandler is an interface that receives an HTTP request
 // and returns an HTTP response.
 type HttpMessageHandler interface {
@@ -23,3 +29,12 @@ type HttpMessageHandlerFunc func(*http.Request) (*http.Response, error)
 func (f HttpMessageHandlerFunc) Send(req *http.Request) (*http.Response, error) {
 	return f(req)
 }
+
+// Resumable is implemented by the HttpMessageHandler of a Middleware
+// that keeps its state across crawls. If Crawler.JobDir is set, Resume
+// is called with it before the first HTTP request is sent.
+type Resumable interface {
+	// Resume restores the state from the directory dir that saved
+	// by the previous crawl, and saves the state into dir.
+	Resume(dir string) error
+}
@@ -0,0 +1,404 @@
+package antch
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Route specifies a Handler for the responses that match the route.
+type Route struct {
+	// Pattern specifies the pattern of the request URL, see
+	// Crawler.Handle for the syntax.
+	Pattern string
+
+	// Methods specifies the methods of the request, such as "GET".
+	// If empty, all methods are matched.
+	Methods []string
+
+	// ContentTypes specifies the media types of the response, such as
+	// "text/html", or "text/*" that matches all text types.
+	// If empty, all content types are matched.
+	ContentTypes []string
+
+	// Handler specifies the Handler to serve the matched responses.
+	Handler Handler
+}
+
+// The classes of routes, the higher class takes precedence if the
+// routes are equally specific.
+const (
+	routeCatchAll = iota
+	routeRegexp
+	routePath
+)
+
+// route is a parsed Route.
+type route struct {
+	Route
+	order int
+	class int
+
+	re       *regexp.Regexp
+	scheme   string
+	host     string
+	hostPort bool
+	segs     []string
+	exact    bool
+
+	// prefix is the route of the literal prefix of the regular
+	// expression, which is used to rank the route.
+	prefix *route
+}
+
+func isParam(s string) bool {
+	return len(s) > 2 && s[0] == '{' && s[len(s)-1] == '}'
+}
+
+func isRestParam(s string) bool {
+	return isParam(s) && strings.HasSuffix(s, "...}")
+}
+
+func isGlob(s string) bool {
+	return s == "**" || strings.ContainsAny(s, "*?[")
+}
+
+func parseRoute(r Route, order int) (*route, error) {
+	e := &route{Route: r, order: order, class: routePath}
+	p := r.Pattern
+	switch {
+	case p == "":
+		return nil, fmt.Errorf("crawler: invalid pattern %q", p)
+	case p == "*":
+		e.class = routeCatchAll
+		return e, nil
+	case p[0] == '~':
+		re, err := regexp.Compile(p[1:])
+		if err != nil {
+			return nil, fmt.Errorf("crawler: invalid pattern %q: %v", p, err)
+		}
+		e.class, e.re = routeRegexp, re
+		if p := prefixPattern(re); p != "" {
+			e.prefix, _ = parseRoute(Route{Pattern: p}, order)
+		}
+		return e, nil
+	}
+
+	if i := strings.Index(p, "://"); i >= 0 {
+		e.scheme, p = strings.ToLower(p[:i]), p[i+3:]
+	}
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		e.host, p = p[:i], p[i:]
+	} else {
+		e.host, p = p, ""
+	}
+	e.host = strings.ToLower(e.host)
+	if _, _, err := net.SplitHostPort(e.host); err == nil {
+		e.hostPort = true
+	}
+	if strings.HasSuffix(p, "{$}") {
+		e.exact, p = true, p[:len(p)-3]
+	}
+	if p = strings.Trim(p, "/"); p != "" {
+		e.segs = strings.Split(p, "/")
+	}
+	for i, s := range e.segs {
+		if isRestParam(s) && i != len(e.segs)-1 {
+			return nil, fmt.Errorf("crawler: invalid pattern %q: %s must be the last segment", r.Pattern, s)
+		}
+		if !isParam(s) && isGlob(s) {
+			if _, err := path.Match(s, ""); err != nil {
+				return nil, fmt.Errorf("crawler: invalid pattern %q: %v", r.Pattern, err)
+			}
+		}
+	}
+	return e, nil
+}
+
+// prefixPattern returns the pattern of the scheme, host and path of
+// the literal prefix of the anchored regular expression, such as
+// "https://example.com/item" of `^https://example\.com/item/\d+`.
+func prefixPattern(re *regexp.Regexp) string {
+	if !strings.HasPrefix(re.String(), "^") {
+		return ""
+	}
+	prefix, complete := re.LiteralPrefix()
+	i := strings.Index(prefix, "://")
+	if i <= 0 {
+		return ""
+	}
+	if j := strings.IndexAny(prefix[i+3:], "?#"); j >= 0 {
+		prefix, complete = prefix[:i+3+j], true
+	}
+	if !complete {
+		// The last segment of prefix may be incomplete.
+		j := strings.LastIndexByte(prefix, '/')
+		if j < i+3 {
+			return ""
+		}
+		prefix = prefix[:j]
+	}
+	return prefix
+}
+
+// rank returns the keys to compare the precedence of routes.
+func (e *route) rank() []int {
+	p := e
+	if e.prefix != nil {
+		p = e.prefix
+	}
+	var host, literals, globs, constraints int
+	switch {
+	case p.host == "":
+	case strings.HasPrefix(p.host, "*."):
+		host = 1
+	default:
+		host = 2
+	}
+	for _, s := range p.segs {
+		switch {
+		case isParam(s):
+		case isGlob(s):
+			globs++
+		default:
+			literals++
+		}
+	}
+	if len(e.Methods) > 0 {
+		constraints++
+	}
+	if len(e.ContentTypes) > 0 {
+		constraints++
+	}
+	scheme := 0
+	if p.scheme != "" {
+		scheme = 1
+	}
+	exact := 0
+	if p.exact {
+		exact = 1
+	}
+	return []int{exact, literals, len(p.segs), -globs, host, e.class, scheme, constraints, -e.order}
+}
+
+// before reports whether e takes precedence over o.
+func (e *route) before(o *route) bool {
+	a, b := e.rank(), o.rank()
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+func (e *route) same(o *route) bool {
+	return e.Pattern == o.Pattern &&
+		fmt.Sprint(e.Methods) == fmt.Sprint(o.Methods) &&
+		fmt.Sprint(e.ContentTypes) == fmt.Sprint(o.ContentTypes)
+}
+
+// match reports whether the response matches e, and returns
+// the captured parameters.
+func (e *route) match(res *http.Response) (map[string]string, bool) {
+	req := res.Request
+	if !e.matchMethod(req.Method) || !e.matchContentType(res.Header.Get("Content-Type")) {
+		return nil, false
+	}
+	u := *req.URL
+	if u.Host == "" {
+		u.Host = req.Host
+	}
+
+	params := make(map[string]string)
+	switch e.class {
+	case routeCatchAll:
+		return params, true
+	case routeRegexp:
+		m := e.re.FindStringSubmatch(u.String())
+		if m == nil {
+			return nil, false
+		}
+		for i, name := range e.re.SubexpNames() {
+			if name != "" {
+				params[name] = m[i]
+			}
+		}
+		return params, true
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "" {
+		scheme = "http"
+	}
+	if e.scheme != "" && e.scheme != scheme {
+		return nil, false
+	}
+	if e.host != "" {
+		host := strings.ToLower(u.Host)
+		if !e.hostPort {
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+		}
+		if !matchSite(e.host, host) {
+			return nil, false
+		}
+	}
+	var segs []string
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		segs = strings.Split(p, "/")
+	}
+	if !matchSegments(e.segs, segs, e.exact, params) {
+		return nil, false
+	}
+	return params, true
+}
+
+func (e *route) matchMethod(method string) bool {
+	if len(e.Methods) == 0 {
+		return true
+	}
+	if method == "" {
+		method = "GET"
+	}
+	for _, m := range e.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *route) matchContentType(v string) bool {
+	if len(e.ContentTypes) == 0 {
+		return true
+	}
+	mediatype, _, err := mime.ParseMediaType(v)
+	if err != nil {
+		return false
+	}
+	for _, t := range e.ContentTypes {
+		t = strings.ToLower(t)
+		if t == mediatype || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediatype, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments reports whether the path segments match the pattern
+// segments, the path can be longer than the pattern unless exact.
+func matchSegments(pat, segs []string, exact bool, params map[string]string) bool {
+	if len(pat) == 0 {
+		return !exact || len(segs) == 0
+	}
+	s := pat[0]
+	switch {
+	case isRestParam(s):
+		params[s[1:len(s)-4]] = strings.Join(segs, "/")
+		return true
+	case s == "**":
+		for i := 0; i <= len(segs); i++ {
+			if matchSegments(pat[1:], segs[i:], exact, params) {
+				return true
+			}
+		}
+		return false
+	case len(segs) == 0:
+		return false
+	case isParam(s):
+		if !matchSegments(pat[1:], segs[1:], exact, params) {
+			return false
+		}
+		params[s[1:len(s)-1]] = segs[0]
+		return true
+	case isGlob(s):
+		if ok, _ := path.Match(s, segs[0]); !ok {
+			return false
+		}
+	case s != segs[0]:
+		return false
+	}
+	return matchSegments(pat[1:], segs[1:], exact, params)
+}
+
+// HandleRoute registers the Handler of the route, see Handle. The
+// route replaces the registered route with the same Pattern, Methods
+// and ContentTypes.
+func (c *Crawler) HandleRoute(r Route) {
+	if r.Handler == nil {
+		panic("crawler: handler is nil")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, err := parseRoute(r, len(c.routes))
+	if err != nil {
+		panic(err)
+	}
+	for i, v := range c.routes {
+		if v.same(e) {
+			e.order = v.order
+			c.routes = append(c.routes[:i], c.routes[i+1:]...)
+			break
+		}
+	}
+	i := 0
+	for i < len(c.routes) && !e.before(c.routes[i]) {
+		i++
+	}
+	c.routes = append(c.routes, nil)
+	copy(c.routes[i+1:], c.routes[i:])
+	c.routes[i] = e
+}
+
+// route returns the Handler of the first matched route for res,
+// and the captured parameters.
+func (c *Crawler) route(res *http.Response) (h Handler, pattern string, params map[string]string) {
+	if NotModified(res) {
+		if c.NotModifiedHandler != nil {
+			return c.NotModifiedHandler, "", nil
+		}
+		return VoidHandler(), "", nil
+	}
+	if h := requestHandler(res.Request); h != nil {
+		return h, "", nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, e := range c.routes {
+		if params, ok := e.match(res); ok {
+			return e.Handler, e.Pattern, params
+		}
+	}
+	return VoidHandler(), "", nil
+}
+
+type paramsKey struct{}
+
+// withRouteParams returns a shallow copy of req with the parameters.
+func withRouteParams(req *http.Request, params map[string]string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), paramsKey{}, params))
+}
+
+// RouteParams returns the parameters captured by the route that
+// matched the response of req, such as {"id": "1"} for the pattern
+// "example.com/item/{id}" and the URL "http://example.com/item/1".
+func RouteParams(req *http.Request) map[string]string {
+	v, _ := req.Context().Value(paramsKey{}).(map[string]string)
+	return v
+}
+
+// RouteParam returns the value of the named parameter captured by the
+// route, or "" if not exists.
+func RouteParam(req *http.Request, name string) string {
+	return RouteParams(req)[name]
+}
@@ -0,0 +1,148 @@
+package antch
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCrawlerRoute(t *testing.T) {
+	var routes = []Route{
+		{Pattern: "*"},
+		{Pattern: "example.com"},
+		{Pattern: "example.com/item"},
+		{Pattern: "example.com/item/{id}"},
+		{Pattern: "example.com/item/new"},
+		{Pattern: "example.com/{$}"},
+		{Pattern: "*.example.com/blog/{path...}"},
+		{Pattern: "example.com/files/**/*.pdf"},
+		{Pattern: "https://example.com/account"},
+		{Pattern: "example.com:8080/admin"},
+		{Pattern: "/search"},
+		{Pattern: "example.com/api", Methods: []string{"POST"}},
+		{Pattern: "example.com/api", ContentTypes: []string{"application/json"}},
+		{Pattern: "example.com/api"},
+		{Pattern: `~^http://example\.org/p/(?P<id>\d+)$`},
+		{Pattern: "~example"},
+		{Pattern: `~^http://example\.com/shop/(?P<id>\d+)$`},
+	}
+	tc := NewCrawler()
+	for i, r := range routes {
+		i := i
+		r.Handler = HandlerFunc(func(c chan<- Item, res *http.Response) {
+			c <- i
+		})
+		tc.HandleRoute(r)
+	}
+
+	var routeTests = []struct {
+		method      string
+		url         string
+		contentType string
+		route       int
+		params      map[string]string
+	}{
+		{"GET", "http://example.com/", "", 5, nil},
+		{"GET", "http://example.com/about", "", 1, nil},
+		{"GET", "http://example.com:8080/item", "", 2, nil},
+		{"GET", "http://example.com/item-archive", "", 1, nil},
+		{"GET", "http://otherexample.com/item", "", 15, nil},
+		{"GET", "http://example.com/item/1", "", 3, map[string]string{"id": "1"}},
+		{"GET", "http://example.com/item/new", "", 4, nil},
+		{"GET", "http://example.com/item/1/reviews", "", 3, map[string]string{"id": "1"}},
+		{"GET", "http://www.example.com/blog/2017/10/post", "", 6, map[string]string{"path": "2017/10/post"}},
+		{"GET", "http://example.com/blog/", "", 6, map[string]string{"path": ""}},
+		{"GET", "http://example.com/files/a/b/doc.pdf", "", 7, nil},
+		{"GET", "http://example.com/files/doc.pdf", "", 7, nil},
+		{"GET", "http://example.com/files/doc.txt", "", 1, nil},
+		{"GET", "https://example.com/account", "", 8, nil},
+		{"GET", "http://example.com/account", "", 1, nil},
+		{"GET", "http://example.com:8080/admin", "", 9, nil},
+		{"GET", "http://example.com/admin", "", 1, nil},
+		{"GET", "http://localhost/search?q=go", "", 10, nil},
+		{"POST", "http://example.com/api", "application/json", 11, nil},
+		{"GET", "http://example.com/api", "application/json; charset=utf-8", 12, nil},
+		{"GET", "http://example.com/api", "text/html", 13, nil},
+		{"GET", "http://example.org/p/42", "", 14, map[string]string{"id": "42"}},
+		{"GET", "http://example.com/shop/42", "", 16, map[string]string{"id": "42"}},
+		{"GET", "http://localhost/", "", 0, nil},
+	}
+	for _, test := range routeTests {
+		u, _ := url.Parse(test.url)
+		res := &http.Response{
+			Request: &http.Request{Method: test.method, URL: u, Host: u.Host},
+			Header:  http.Header{"Content-Type": {test.contentType}},
+		}
+		h, pattern, params := tc.route(res)
+		c := make(chan Item, 1)
+		h.ServeSpider(c, res)
+		if g, e := (<-c).(int), test.route; g != e {
+			t.Errorf("%s %s expected route %d; got %d (%s)", test.method, test.url, e, g, pattern)
+			continue
+		}
+		if len(params) == 0 && len(test.params) == 0 {
+			continue
+		}
+		if g, e := fmt.Sprint(params), fmt.Sprint(test.params); g != e {
+			t.Errorf("%s params expected %s; got %s", test.url, e, g)
+		}
+	}
+}
+
+func TestCrawlerRouteContentType(t *testing.T) {
+	tc := NewCrawler()
+	tc.HandleRoute(Route{
+		Pattern:      "example.com",
+		ContentTypes: []string{"text/*"},
+		Handler:      VoidHandler(),
+	})
+	u, _ := url.Parse("http://example.com/")
+	for _, v := range []string{"text/html", "text/plain; charset=utf-8", "application/json", ""} {
+		res := &http.Response{
+			Request: &http.Request{Method: "GET", URL: u},
+			Header:  http.Header{"Content-Type": {v}},
+		}
+		_, pattern, _ := tc.route(res)
+		if g, e := pattern != "", v != "" && v != "application/json"; g != e {
+			t.Errorf("%q matched %v; want %v", v, g, e)
+		}
+	}
+}
+
+func TestCrawlerRouteParams(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.Handle("/item/{id}/{rest...}", HandlerFunc(func(c chan<- Item, res *http.Response) {
+		c <- RouteParam(res.Request, "id") + ":" + RouteParam(res.Request, "rest")
+	}))
+	c := make(chan Item)
+	tc.UsePipeline(func(_ PipelineHandler) PipelineHandler {
+		return PipelineHandlerFunc(func(v Item) {
+			c <- v
+		})
+	})
+
+	tc.StartURLs([]string{ts.URL + "/item/9/reviews/2"})
+	if g, e := (<-c).(string), "9:reviews/2"; g != e {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestHandleInvalidPattern(t *testing.T) {
+	for _, pattern := range []string{"", "~(", "example.com/{path...}/x", "example.com/[a"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Handle(%q) expected panic", pattern)
+				}
+			}()
+			NewCrawler().Handle(pattern, VoidHandler())
+		}()
+	}
+}
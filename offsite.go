@@ -0,0 +1,56 @@
+package antch
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrOffsite is returned by Crawler.Crawl and OffsiteMiddleware if
+// the host of request is not in the allowed domains.
+var ErrOffsite = errors.New("crawler: request is offsite")
+
+// OffsiteFilter filters the requests whose host is not in the allowed
+// domains.
+type OffsiteFilter struct {
+	// AllowedDomains specifies the domains that allowed to crawl,
+	// a domain such as "example.com" allows example.com and all its
+	// subdomains.
+	// If empty, all domains are allowed.
+	AllowedDomains []string
+}
+
+// Allow reports whether the request to URL u is allowed.
+func (f *OffsiteFilter) Allow(u *url.URL) bool {
+	return len(f.AllowedDomains) == 0 || matchDomains(u.Hostname(), f.AllowedDomains)
+}
+
+// matchDomains reports whether the host is one of the domains or
+// their subdomains.
+func matchDomains(host string, domains []string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// OffsiteMiddleware is a middleware that denies the HTTP requests
+// filtered by f.
+//
+// Use Crawler.AllowedDomains to filter the requests before they are
+// scheduled.
+func OffsiteMiddleware(f *OffsiteFilter) Middleware {
+	return func(next HttpMessageHandler) HttpMessageHandler {
+		return HttpMessageHandlerFunc(func(req *http.Request) (*http.Response, error) {
+			if !f.Allow(req.URL) {
+				return nil, ErrOffsite
+			}
+			return next.Send(req)
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package antch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOffsiteFilter(t *testing.T) {
+	f := &OffsiteFilter{AllowedDomains: []string{"example.com", ".example.net"}}
+	var offsiteTests = []struct {
+		url   string
+		allow bool
+	}{
+		{"http://example.com/", true},
+		{"https://www.Example.com:8080/", true},
+		{"http://a.b.example.net/", true},
+		{"http://example.org/", false},
+		{"http://notexample.com/", false},
+		{"http://example.com.evil.org/", false},
+		{"http://example.org/about", false},
+	}
+	for _, test := range offsiteTests {
+		u, _ := url.Parse(test.url)
+		if g, e := f.Allow(u), test.allow; g != e {
+			t.Errorf("Allow(%s) = %v; want %v", test.url, g, e)
+		}
+	}
+}
+
+func TestCrawlerAllowedDomains(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://redirect.invalid/", http.StatusFound)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.AllowedDomains = []string{"127.0.0.1"}
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		mu.Lock()
+		paths = append(paths, resp.Request.URL.Path)
+		mu.Unlock()
+		if resp.Request.URL.Path == "/" {
+			for _, URL := range []string{ts.URL + "/a", ts.URL + "/redirect", "http://other.invalid/"} {
+				req, _ := http.NewRequest("GET", URL, nil)
+				c <- req
+			}
+		}
+	}))
+	tc.StartURLs([]string{ts.URL + "/", "http://other.invalid/start"})
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	sort.Strings(paths)
+	if g, e := fmt.Sprint(paths), "[/ /a]"; g != e {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	stats := tc.Stats()
+	if g, e := stats[""]["requests/filtered/offsite"], int64(3); g != e {
+		t.Errorf("expected %d offsite requests; got %d", e, g)
+	}
+	if g, e := stats["other.invalid"]["requests/filtered/offsite"], int64(2); g != e {
+		t.Errorf("expected %d offsite requests of other.invalid; got %d", e, g)
+	}
+}
@@ -0,0 +1,145 @@
+package antch
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Pause pauses the crawl, the Crawler stops sending new requests
+// until Resume is called. The requests in the Scheduler and the
+// requests that have been dispatched to the per-site spiders are
+// kept, the in-flight requests, the Handlers and the pipeline are
+// not affected.
+//
+// Wait and Run are blocked while the crawl is paused, Shutdown sends
+// the requests that have been dispatched to the spiders and leaves
+// others in the Scheduler.
+func (c *Crawler) Pause() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumeCh == nil {
+		c.resumeCh = make(chan struct{})
+	}
+}
+
+// Resume resumes the crawl paused by Pause. The sites paused by
+// PauseSite are still paused.
+func (c *Crawler) Resume() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumeCh != nil {
+		close(c.resumeCh)
+		c.resumeCh = nil
+	}
+}
+
+// Paused reports whether the crawl is paused.
+func (c *Crawler) Paused() bool {
+	return c.pausedCh("") != nil
+}
+
+// PauseSite pauses the website of the host name such as "example.com",
+// the Crawler stops sending new requests to the site until ResumeSite
+// is called, such as to back off a site that responds 429 Too Many
+// Requests. Other sites are not affected.
+//
+// The requests of the site that taken from the Scheduler are held in
+// memory, they are put back into the Scheduler when the site is resumed
+// or the Crawler is shut down.
+func (c *Crawler) PauseSite(host string) {
+	if host == "" {
+		return
+	}
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.pausedSites == nil {
+		c.pausedSites = make(map[string]chan struct{})
+	}
+	if _, ok := c.pausedSites[host]; !ok {
+		c.pausedSites[host] = make(chan struct{})
+	}
+}
+
+// ResumeSite resumes the website paused by PauseSite, its requests
+// are sent unless the crawl is paused.
+func (c *Crawler) ResumeSite(host string) {
+	c.pauseMu.Lock()
+	if ch, ok := c.pausedSites[host]; ok {
+		close(ch)
+		delete(c.pausedSites, host)
+	}
+	c.pauseMu.Unlock()
+	c.releaseHeld(host)
+}
+
+// PausedSites returns the host names of the paused sites in order.
+func (c *Crawler) PausedSites() []string {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	hosts := make([]string, 0, len(c.pausedSites))
+	for host := range c.pausedSites {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// pausedCh returns a channel that is closed when the crawl or the site
+// of host is resumed, or nil if both are not paused. The pause of the
+// crawl is checked first for any host, the site is checked only if
+// the crawl is not paused, and host "" checks the crawl only.
+func (c *Crawler) pausedCh(host string) <-chan struct{} {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumeCh != nil {
+		return c.resumeCh
+	}
+	if ch, ok := c.pausedSites[host]; ok {
+		return ch
+	}
+	return nil
+}
+
+// holdRequest holds req if its site is paused, it returns false if
+// the site is not paused or the Crawler is closing.
+func (c *Crawler) holdRequest(req *http.Request) bool {
+	host := req.URL.Hostname()
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if _, ok := c.pausedSites[host]; !ok {
+		return false
+	}
+	select {
+	case <-c.closing:
+		return false
+	case <-c.quit:
+		return false
+	default:
+	}
+	if c.held == nil {
+		c.held = make(map[string][]*http.Request)
+	}
+	c.held[host] = append(c.held[host], req)
+	return true
+}
+
+// releaseHeld puts the held requests of host back into the Scheduler,
+// or the held requests of all sites if host is "".
+func (c *Crawler) releaseHeld(host string) {
+	c.pauseMu.Lock()
+	var reqs []*http.Request
+	for h, a := range c.held {
+		if host == "" || h == host {
+			reqs = append(reqs, a...)
+			delete(c.held, h)
+		}
+	}
+	c.pauseMu.Unlock()
+
+	for _, req := range reqs {
+		if err := c.scheduler.Push(req); err != nil {
+			closeRequest(req)
+			c.addPending(-1)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package antch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCrawlerPauseSite(t *testing.T) {
+	var mu sync.Mutex
+	hosts := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts[strings.Split(r.Host, ":")[0]]++
+		mu.Unlock()
+	}))
+	defer ts.Close()
+	localhost := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+	count := func(host string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hosts[host]
+	}
+
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.PauseSite("localhost")
+	tc.StartURLs([]string{localhost + "/1", ts.URL + "/1", localhost + "/2", ts.URL + "/2"})
+
+	for i := 0; i < 100 && count("127.0.0.1") < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if g, e := count("127.0.0.1"), 2; g != e {
+		t.Errorf("127.0.0.1 expected %d requests; got %d", e, g)
+	}
+	if g := count("localhost"); g != 0 {
+		t.Errorf("localhost expected no requests while paused; got %d", g)
+	}
+	if g, e := fmt.Sprint(tc.PausedSites()), "[localhost]"; g != e {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+
+	// The site is still paused after the crawl is resumed.
+	tc.Pause()
+	tc.Resume()
+	tc.EnqueueURL(ts.URL + "/3")
+	for i := 0; i < 100 && count("127.0.0.1") < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if g := count("localhost"); g != 0 {
+		t.Errorf("localhost expected no requests while paused; got %d", g)
+	}
+
+	tc.ResumeSite("localhost")
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if g, e := count("localhost"), 2; g != e {
+		t.Errorf("localhost expected %d requests; got %d", e, g)
+	}
+	if g := len(tc.PausedSites()); g != 0 {
+		t.Errorf("expected no paused sites; got %d", g)
+	}
+}
+
+func TestCrawlerPauseSiteShutdown(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.PauseSite("127.0.0.1")
+	tc.StartURLs([]string{ts.URL + "/a", ts.URL + "/b", ts.URL + "/c"})
+	for i := 0; i < 100 && tc.scheduler.Len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tc.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	// The held requests are put back into the Scheduler.
+	if g, e := tc.scheduler.Len(), 3; g != e {
+		t.Errorf("expected %d requests in the Scheduler; got %d", e, g)
+	}
+}
+
+func TestCrawlerPauseShutdown(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	tc.Pause()
+	tc.StartURLs([]string{ts.URL + "/a", ts.URL + "/b"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tc.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	// The requests are kept in the Scheduler.
+	if g, e := tc.scheduler.Len(), 2; g != e {
+		t.Errorf("expected %d requests in the Scheduler; got %d", e, g)
+	}
+	if n := tc.Stats()[""]["requests/sent"]; n != 0 {
+		t.Errorf("expected no requests sent; got %d", n)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"context"
 	"encoding/base64"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
@@ -19,6 +18,26 @@ import (
 // ProxyKey is a key for the proxy URL that used by Crawler.
 type ProxyKey struct{}
 
+// ProxyError is the error of requests that failed to connect to the
+// remote server via the proxy, or failed to get the proxy URL. Use
+// errors.As to check the error.
+type ProxyError struct {
+	// URL is the URL of proxy, it's nil if failed to get the URL.
+	URL *url.URL
+	Err error
+}
+
+func (e *ProxyError) Error() string {
+	if e.URL == nil {
+		return "proxy: " + e.Err.Error()
+	}
+	return "proxy " + e.URL.Host + ": " + e.Err.Error()
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
 func proxyHandler(f func(*http.Request) (*url.URL, error), next HttpMessageHandler) HttpMessageHandler {
 	// Registers proxy protocol(HTTP,HTTPS,SOCKS5).
 	proxy.RegisterDialerType("http", httpProxy)
@@ -27,7 +46,7 @@ func proxyHandler(f func(*http.Request) (*url.URL, error), next HttpMessageHandl
 	return HttpMessageHandlerFunc(func(req *http.Request) (*http.Response, error) {
 		proxyURL, err := f(req)
 		if err != nil {
-			return nil, err
+			return nil, &ProxyError{Err: err}
 		}
 		ctx := context.WithValue(req.Context(), ProxyKey{}, proxyURL)
 		return next.Send(req.WithContext(ctx))
@@ -38,11 +57,16 @@ var zeroDialer net.Dialer
 
 func proxyDialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	if v := ctx.Value(ProxyKey{}); v != nil {
-		dialer, err := proxy.FromURL(v.(*url.URL), proxy.Direct)
+		proxyURL := v.(*url.URL)
+		dialer, err := proxy.FromURL(proxyURL, proxy.Direct)
+		if err != nil {
+			return nil, &ProxyError{URL: proxyURL, Err: err}
+		}
+		conn, err := dialer.Dial(network, address)
 		if err != nil {
-			return nil, err
+			return nil, &ProxyError{URL: proxyURL, Err: err}
 		}
-		return dialer.Dial(network, address)
+		return conn, nil
 	}
 	return zeroDialer.DialContext(ctx, network, address)
 }
@@ -107,7 +131,7 @@ func (d *httpDialer) Dial(network, addr string) (net.Conn, error) {
 	if resp.StatusCode != 200 {
 		conn.Close()
 		f := strings.SplitN(resp.Status, " ", 2)
-		return nil, fmt.Errorf("proxy: %v", errors.New(f[1]))
+		return nil, errors.New(f[1])
 	}
 
 	return conn, nil
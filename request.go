@@ -0,0 +1,157 @@
+package antch
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+type handlerKey struct{}
+
+// WithHandler returns a shallow copy of req with the Handler h attached.
+// The response of the returned request is served by h instead of the
+// Handler registered for its URL.
+func WithHandler(req *http.Request, h Handler) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), handlerKey{}, h))
+}
+
+// requestHandler returns a Handler that attached to the req.
+func requestHandler(req *http.Request) Handler {
+	if req == nil {
+		return nil
+	}
+	h, _ := req.Context().Value(handlerKey{}).(Handler)
+	return h
+}
+
+type errorHandlerKey struct{}
+
+// WithErrorHandler returns a shallow copy of req with the ErrorHandler
+// h attached. If the returned request failed, the error is served by h
+// instead of the Crawler's ErrorHandler.
+func WithErrorHandler(req *http.Request, h ErrorHandler) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), errorHandlerKey{}, h))
+}
+
+// requestErrorHandler returns an ErrorHandler that attached to the req.
+func requestErrorHandler(req *http.Request) ErrorHandler {
+	h, _ := req.Context().Value(errorHandlerKey{}).(ErrorHandler)
+	return h
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a shallow copy of req with the given priority.
+// The requests with higher priority are crawled first, the default
+// priority is 0 and negative values are allowed to lower priority.
+func WithPriority(req *http.Request, priority int) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), priorityKey{}, priority))
+}
+
+// Priority returns the priority of the req.
+func Priority(req *http.Request) int {
+	v, _ := req.Context().Value(priorityKey{}).(int)
+	return v
+}
+
+type depthKey struct{}
+
+// withDepth returns a shallow copy of req with the given depth.
+func withDepth(req *http.Request, depth int) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), depthKey{}, depth))
+}
+
+// Depth returns the depth of the req, that is the number of links
+// followed from a start request to it. The depth of start requests
+// is 0, and the depth of a follow-up request is one more than the
+// request of the response it comes from.
+func Depth(req *http.Request) int {
+	v, _ := req.Context().Value(depthKey{}).(int)
+	return v
+}
+
+// Meta is the metadata of a request, a set of key-value pairs that
+// carried from the request to the Handler of its response, such as
+// the category of the page that a product link comes from. The meta
+// is kept across middlewares, redirects and retries.
+//
+// The values should be encodable by encoding/json if the requests are
+// kept by NewDiskQueue, the numbers are restored as float64.
+type Meta map[string]interface{}
+
+// Get returns the value of the key, or nil if not exists.
+func (m Meta) Get(key string) interface{} {
+	return m[key]
+}
+
+// String returns the string value of the key, or "" if not exists
+// or the value is not a string.
+func (m Meta) String(key string) string {
+	v, _ := m[key].(string)
+	return v
+}
+
+// Int returns the integer value of the key, or 0 if not exists or
+// the value is not a number.
+func (m Meta) Int(key string) int {
+	switch v := m[key].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	case json.Number:
+		n, _ := v.Int64()
+		return int(n)
+	}
+	return 0
+}
+
+// Bool returns the boolean value of the key, or false if not exists
+// or the value is not a bool.
+func (m Meta) Bool(key string) bool {
+	v, _ := m[key].(bool)
+	return v
+}
+
+type metaKey struct{}
+
+// WithMeta returns a shallow copy of req with the meta attached, the
+// meta is merged into a copy of the meta of req.
+func WithMeta(req *http.Request, meta Meta) *http.Request {
+	m := make(Meta)
+	for k, v := range RequestMeta(req) {
+		m[k] = v
+	}
+	for k, v := range meta {
+		m[k] = v
+	}
+	return req.WithContext(context.WithValue(req.Context(), metaKey{}, m))
+}
+
+// RequestMeta returns the meta of the req, or nil if it has no meta.
+// The returned Meta should not be modified, use WithMeta instead.
+func RequestMeta(req *http.Request) Meta {
+	if req == nil {
+		return nil
+	}
+	m, _ := req.Context().Value(metaKey{}).(Meta)
+	return m
+}
+
+type dontFilterKey struct{}
+
+// WithDontFilter returns a shallow copy of req that should not be
+// filtered by the dupe filters, so that it is crawled even if it has
+// been visited before.
+func WithDontFilter(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), dontFilterKey{}, true))
+}
+
+// DontFilter reports whether the req should not be filtered by
+// the dupe filters.
+func DontFilter(req *http.Request) bool {
+	v, _ := req.Context().Value(dontFilterKey{}).(bool)
+	return v
+}
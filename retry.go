@@ -0,0 +1,200 @@
+package antch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy specifies how the RetryMiddleware retries the failed
+// HTTP requests.
+type RetryPolicy struct {
+	// MaxRetries specifies the maximum number of times to retry
+	// a request.
+	// Default is 2.
+	MaxRetries int
+
+	// StatusCodes specifies the HTTP status codes of the response
+	// that should be retried.
+	// Default is 500, 502, 503, 504, 408, 429.
+	StatusCodes []int
+
+	// BaseDelay specifies a time to wait before the first retry, the
+	// delay is doubled for each of retries with a random jitter.
+	// Default is 1s.
+	BaseDelay time.Duration
+
+	// MaxDelay specifies the maximum time to wait before a retry,
+	// includes the delay of the Retry-After header.
+	// Default is 60s.
+	MaxDelay time.Duration
+}
+
+var defaultRetryStatusCodes = []int{500, 502, 503, 504, 408, 429}
+
+func (p *RetryPolicy) maxRetries() int {
+	if v := p.MaxRetries; v > 0 {
+		return v
+	}
+	return 2
+}
+
+func (p *RetryPolicy) baseDelay() time.Duration {
+	if v := p.BaseDelay; v > 0 {
+		return v
+	}
+	return 1 * time.Second
+}
+
+func (p *RetryPolicy) maxDelay() time.Duration {
+	if v := p.MaxDelay; v > 0 {
+		return v
+	}
+	return 60 * time.Second
+}
+
+func (p *RetryPolicy) retryStatus(code int) bool {
+	codes := p.StatusCodes
+	if codes == nil {
+		codes = defaultRetryStatusCodes
+	}
+	for _, v := range codes {
+		if v == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the n-th retry.
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	d := p.baseDelay() << uint(n-1)
+	if d <= 0 || d > p.maxDelay() {
+		d = p.maxDelay()
+	}
+	// Equal jitter, the delay is between d/2 and d.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter returns the delay of the Retry-After header, which can be
+// a number of seconds or an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(time.Now()); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+type retryKey struct{}
+
+// Retries returns the number of times the req has been retried
+// by RetryMiddleware.
+func Retries(req *http.Request) int {
+	v, _ := req.Context().Value(retryKey{}).(int)
+	return v
+}
+
+func retryHandler(p RetryPolicy, next HttpMessageHandler) HttpMessageHandler {
+	return HttpMessageHandlerFunc(func(req *http.Request) (*http.Response, error) {
+		for n := Retries(req) + 1; ; n++ {
+			resp, err := next.Send(req)
+			var delay time.Duration
+			switch {
+			case err != nil:
+				if !isNetworkError(err) || req.Context().Err() != nil {
+					return resp, err
+				}
+				delay = p.backoff(n)
+			case p.retryStatus(resp.StatusCode):
+				if d, ok := retryAfter(resp); ok {
+					delay = d
+				} else {
+					delay = p.backoff(n)
+				}
+			default:
+				return resp, err
+			}
+			if n > p.maxRetries() {
+				IncStat(req, "retries/max_reached", 1)
+				return resp, err
+			}
+			r := req.WithContext(context.WithValue(req.Context(), retryKey{}, n))
+			if req.Body != nil && req.Body != http.NoBody {
+				// The request body has been consumed, it can be
+				// sent again only if GetBody is available.
+				if req.GetBody == nil {
+					return resp, err
+				}
+				body, err2 := req.GetBody()
+				if err2 != nil {
+					return resp, err
+				}
+				r.Body = body
+			}
+			if resp != nil {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+
+			if delay > p.maxDelay() {
+				delay = p.maxDelay()
+			}
+			// The slot of the site is released while waiting, so the
+			// other requests to the site are not blocked.
+			sl, _ := req.Context().Value(slotKey{}).(*slot)
+			if sl != nil {
+				sl.release()
+			}
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+			if sl != nil && !sl.acquire(req.Context().Done()) {
+				return nil, req.Context().Err()
+			}
+			IncStat(req, "retries", 1)
+			req = r
+		}
+	})
+}
+
+// RetryMiddleware is a middleware that retries the HTTP requests failed
+// with network errors or the specified HTTP status codes, the delay
+// between retries uses exponential backoff, or honours the Retry-After
+// header of the response.
+//
+// The RequestTimeout of the Crawler applies to each attempt, and the
+// slot of the site is released while waiting to retry.
+//
+// RetryMiddleware should be added after other middlewares, so that
+// the retried requests are not denied by them, such as dupe filters.
+func RetryMiddleware(p RetryPolicy) Middleware {
+	return func(next HttpMessageHandler) HttpMessageHandler {
+		return retryHandler(p, next)
+	}
+}
@@ -0,0 +1,221 @@
+package antch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryHandler(t *testing.T) {
+	n := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		if n < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	handler := RetryMiddleware(RetryPolicy{BaseDelay: time.Millisecond})(defaultMessageHandler())
+	req, _ := http.NewRequest("POST", ts.URL, strings.NewReader("q=go"))
+	resp, err := handler.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status code %d; got %d", http.StatusOK, resp.StatusCode)
+	}
+	if g, e := Retries(resp.Request), 2; g != e {
+		t.Errorf("Retries() expected %d; got %d", e, g)
+	}
+}
+
+func TestRetryHandlerMaxRetries(t *testing.T) {
+	n := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	handler := RetryMiddleware(RetryPolicy{MaxRetries: 3, BaseDelay: time.Hour})(defaultMessageHandler())
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	resp, err := handler.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status code %d; got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	if g, e := n, 4; g != e {
+		t.Errorf("expected %d requests; got %d", e, g)
+	}
+}
+
+func TestRetryHandlerNetworkError(t *testing.T) {
+	n := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		if n == 1 {
+			// Closes the connection without response.
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	handler := RetryMiddleware(RetryPolicy{BaseDelay: time.Millisecond})(defaultMessageHandler())
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	resp, err := handler.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := Retries(resp.Request), 1; g != e {
+		t.Errorf("Retries() expected %d; got %d", e, g)
+	}
+}
+
+func TestCrawlerRetry(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		n := hits[r.URL.Path]
+		mu.Unlock()
+		if n == 1 {
+			switch r.URL.Path {
+			case "/unavailable":
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			case "/slow":
+				time.Sleep(150 * time.Millisecond)
+			}
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	var served []string
+	tc := NewCrawler().UseMiddleware(RetryMiddleware(RetryPolicy{BaseDelay: 200 * time.Millisecond}))
+	tc.DownloadDelay = time.Millisecond
+	tc.RequestTimeout = 100 * time.Millisecond
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		mu.Lock()
+		defer mu.Unlock()
+		served = append(served, resp.Request.URL.Path)
+	}))
+	tc.ErrorHandler = ErrorHandlerFunc(func(_ chan<- Item, req *http.Request, err error) {
+		t.Errorf("%s got error: %v", req.URL.Path, err)
+	})
+	tc.StartURLs([]string{ts.URL + "/unavailable", ts.URL + "/ok", ts.URL + "/slow"})
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// The /ok is crawled while /unavailable is waiting to retry.
+	if len(served) == 0 || served[0] != "/ok" {
+		t.Errorf("expected /ok is served first; got %v", served)
+	}
+	// The /slow is timed out at the first attempt only.
+	sort.Strings(served)
+	if g, e := fmt.Sprint(served), "[/ok /slow /unavailable]"; g != e {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestCrawlerRetryLatency(t *testing.T) {
+	n := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		if n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	tc := NewCrawler().UseMiddleware(RetryMiddleware(RetryPolicy{BaseDelay: 200 * time.Millisecond}))
+	tc.DownloadDelay = time.Millisecond
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {}))
+	tc.StartURLs([]string{ts.URL})
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// Each attempt is observed, the delay to retry is not counted.
+	u, _ := url.Parse(ts.URL)
+	h := tc.metrics.latency[u.Hostname()]
+	if h == nil {
+		t.Fatalf("expected the latency of %s is observed", u.Hostname())
+	}
+	if g, e := h.count, uint64(2); g != e {
+		t.Errorf("expected %d attempts observed; got %d", e, g)
+	}
+	if h.sum >= 0.2 {
+		t.Errorf("expected the latency < 0.2s; got %vs", h.sum)
+	}
+}
+
+func TestCrawlerRetryProxyError(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	proxyURL, _ := url.Parse(closed.URL)
+
+	var got error
+	tc := NewCrawler().UseProxy(proxyURL).UseMiddleware(RetryMiddleware(RetryPolicy{BaseDelay: time.Millisecond}))
+	tc.DownloadDelay = time.Millisecond
+	tc.ErrorHandler = ErrorHandlerFunc(func(_ chan<- Item, _ *http.Request, err error) {
+		got = err
+	})
+	tc.EnqueueURL(ts.URL)
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	var perr *ProxyError
+	if !errors.As(got, &perr) {
+		t.Errorf("expected ProxyError; got %v", got)
+	}
+	// The refused connection to the proxy is retried.
+	if g, e := tc.Stats()[""]["retries"], int64(2); g != e {
+		t.Errorf("expected %d retries; got %d", e, g)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	var retryAfterTests = []struct {
+		value string
+		min   time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"120", 120 * time.Second, true},
+		{date, 59 * time.Minute, true},
+		{"soon", 0, false},
+	}
+	for _, test := range retryAfterTests {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Retry-After", test.value)
+		d, ok := retryAfter(resp)
+		if ok != test.ok || d < test.min {
+			t.Errorf("retryAfter(%q) = %v, %v; want >= %v, %v", test.value, d, ok, test.min, test.ok)
+		}
+	}
+}
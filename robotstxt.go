@@ -1,11 +1,16 @@
 package antch
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,13 +18,28 @@ import (
 )
 
 type robotsEntry struct {
-	data *robotstxt.RobotsData
-	url  string
-	last time.Time
+	url string
+
+	mu    sync.RWMutex
+	data  *robotstxt.RobotsData
+	rates map[string]time.Duration
+	last  time.Time
 }
 
 func (e *robotsEntry) update(proxyURL *url.URL) {
+	e.mu.Lock()
 	e.last = time.Now()
+	e.mu.Unlock()
+
+	data, rates := e.fetch(proxyURL)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.data = data
+	e.rates = rates
+}
+
+func (e *robotsEntry) fetch(proxyURL *url.URL) (*robotstxt.RobotsData, map[string]time.Duration) {
 	allAllowed := func() *robotstxt.RobotsData {
 		return &robotstxt.RobotsData{}
 	}
@@ -38,56 +58,200 @@ func (e *robotsEntry) update(proxyURL *url.URL) {
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		e.data = allAllowed()
-		return
+		return allAllowed(), nil
 	}
 	defer resp.Body.Close()
-	data, err := robotstxt.FromResponse(resp)
-	if err == nil {
-		e.data = data
-	} else {
-		e.data = allAllowed()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return allAllowed(), nil
+	}
+	data, err := robotstxt.FromStatusAndBytes(resp.StatusCode, body)
+	if err != nil {
+		return allAllowed(), nil
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return data, parseRequestRates(body)
+	}
+	return data, nil
+}
+
+func (e *robotsEntry) testAgent(path, agent string) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.data.TestAgent(path, agent)
+}
+
+// crawlDelay returns the larger of Crawl-delay and Request-rate
+// of the group that matches agent.
+func (e *robotsEntry) crawlDelay(agent string) time.Duration {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var d time.Duration
+	if g := e.data.FindGroup(agent); g != nil {
+		d = g.CrawlDelay
+	}
+	if v := findRequestRate(e.rates, agent); v > d {
+		d = v
 	}
+	return d
 }
 
-func robotstxtHandler(next HttpMessageHandler) HttpMessageHandler {
+// parseRequestRates parses the Request-rate directives of robots.txt,
+// such as "Request-rate: 1/5" means 1 request per 5 seconds. It returns
+// the time between requests for each user-agent, it's 0 if the group
+// of the user-agent has no Request-rate.
+func parseRequestRates(body []byte) map[string]time.Duration {
 	var (
-		mu sync.RWMutex
-		m  = make(map[string]*robotsEntry)
+		m       = make(map[string]time.Duration)
+		agents  []string
+		inGroup bool
 	)
-
-	get := func(URL string, proxyURL *url.URL) *robotstxt.RobotsData {
-		mu.RLock()
-		e := m[URL]
-		mu.RUnlock()
-
-		if e == nil {
-			mu.Lock()
-			defer mu.Unlock()
-			e = &robotsEntry{url: URL}
-			e.update(proxyURL)
-			m[URL] = e
-			return e.data
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
 		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		switch key {
+		case "user-agent":
+			if inGroup {
+				agents = nil
+				inGroup = false
+			}
+			agent := strings.ToLower(value)
+			if _, ok := m[agent]; !ok {
+				m[agent] = 0
+			}
+			agents = append(agents, agent)
+		case "request-rate":
+			inGroup = true
+			if d, ok := parseRequestRate(value); ok {
+				for _, agent := range agents {
+					m[agent] = d
+				}
+			}
+		default:
+			inGroup = true
+		}
+	}
+	return m
+}
 
-		if (time.Now().Sub(e.last).Hours()) >= 24 {
-			go e.update(proxyURL)
+// parseRequestRate parses a value such as "1/5", "1/10s" or "30/1m"
+// and returns the time between requests.
+func parseRequestRate(v string) (time.Duration, bool) {
+	if f := strings.Fields(v); len(f) > 0 {
+		// Ignores the optional time of day, such as "1/5 0600-0845".
+		v = f[0]
+	}
+	i := strings.IndexByte(v, '/')
+	if i < 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v[:i])
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	period, unit := v[i+1:], time.Second
+	if k := len(period); k > 0 {
+		switch period[k-1] {
+		case 's':
+			period = period[:k-1]
+		case 'm':
+			period, unit = period[:k-1], time.Minute
+		case 'h':
+			period, unit = period[:k-1], time.Hour
 		}
-		return e.data
 	}
+	p, err := strconv.Atoi(period)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return time.Duration(p) * unit / time.Duration(n), true
+}
 
-	return HttpMessageHandlerFunc(func(req *http.Request) (*http.Response, error) {
-		var proxyURL *url.URL
-		if v := req.Context().Value(ProxyKey{}); v != nil {
-			proxyURL = v.(*url.URL)
+// findRequestRate returns the Request-rate of the longest user-agent
+// that matches agent, or the "*" user-agent if no one matches. The
+// group is chosen like the rules and Crawl-delay, the Request-rate of
+// "*" is not used if agent has its own group.
+func findRequestRate(m map[string]time.Duration, agent string) time.Duration {
+	agent = strings.ToLower(agent)
+	d, n := m["*"], 0
+	for k, v := range m {
+		if k != "*" && strings.HasPrefix(agent, k) && len(k) > n {
+			d, n = v, len(k)
 		}
-		r := get(robotstxtURL(req.URL), proxyURL)
-		ua := req.Header.Get("User-Agent")
-		if r.TestAgent(req.URL.Path, ua) {
-			return next.Send(req)
+	}
+	return d
+}
+
+// ErrRobotsDenied is returned by RobotstxtMiddleware if the request
+// is disallowed by the robots.txt of the website.
+var ErrRobotsDenied = errors.New("request was denied by robots.txt")
+
+type robotstxtHandler struct {
+	mu   sync.RWMutex
+	m    map[string]*robotsEntry
+	next HttpMessageHandler
+}
+
+func (h *robotstxtHandler) get(URL string, proxyURL *url.URL) *robotsEntry {
+	h.mu.RLock()
+	e := h.m[URL]
+	h.mu.RUnlock()
+
+	if e == nil {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if e = h.m[URL]; e != nil {
+			return e
 		}
-		return nil, errors.New("request was denied by robots.txt")
-	})
+		e = &robotsEntry{url: URL}
+		e.update(proxyURL)
+		h.m[URL] = e
+		return e
+	}
+
+	e.mu.RLock()
+	last := e.last
+	e.mu.RUnlock()
+	if (time.Now().Sub(last).Hours()) >= 24 {
+		go e.update(proxyURL)
+	}
+	return e
+}
+
+func (h *robotstxtHandler) Send(req *http.Request) (*http.Response, error) {
+	var proxyURL *url.URL
+	if v := req.Context().Value(ProxyKey{}); v != nil {
+		proxyURL = v.(*url.URL)
+	}
+	e := h.get(robotstxtURL(req.URL), proxyURL)
+	ua := req.Header.Get("User-Agent")
+	if e.testAgent(req.URL.Path, ua) {
+		return h.next.Send(req)
+	}
+	return nil, ErrRobotsDenied
+}
+
+// CrawlDelay returns the delay between requests that robots.txt asks
+// for the user-agent, by the Crawl-delay or Request-rate directive.
+// It returns 0 if the robots.txt of the website was not fetched yet.
+func (h *robotstxtHandler) CrawlDelay(u *url.URL, agent string) time.Duration {
+	h.mu.RLock()
+	e := h.m[robotstxtURL(u)]
+	h.mu.RUnlock()
+	if e == nil {
+		return 0
+	}
+	return e.crawlDelay(agent)
 }
 
 func robotstxtURL(u *url.URL) string {
@@ -96,6 +260,11 @@ func robotstxtURL(u *url.URL) string {
 
 // RobotstxtMiddleware is a middleware for robots.txt, make HTTP
 // request is more polite.
+//
+// The Crawler adopts the Crawl-delay and Request-rate of robots.txt
+// as the download delay of the website, see Crawler.RobotstxtMaxDelay.
 func RobotstxtMiddleware() Middleware {
-	return Middleware(robotstxtHandler)
+	return func(next HttpMessageHandler) HttpMessageHandler {
+		return &robotstxtHandler{next: next, m: make(map[string]*robotsEntry)}
+	}
 }
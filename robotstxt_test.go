@@ -6,6 +6,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"testing"
+	"time"
 )
 
 const robotsText = "User-agent: * \nDisallow: /account/\nDisallow: /ping\nAllow: /shopping/$\nUser-agent: Twitterbot\nDisallow: /\nSitemap: http://www.bing.com/dict/sitemap-index.xml"
@@ -86,3 +87,69 @@ func TestRobotstxtWithProxyHandler(t *testing.T) {
 		t.Errorf("request path /, err = %v; want nil", err)
 	}
 }
+
+func TestRobotstxtCrawlDelay(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("User-agent: *\nCrawl-delay: 2\nRequest-rate: 1/1s\n\nUser-agent: slowbot\nRequest-rate: 1/10s\nDisallow: /private/\n\nUser-agent: fastbot\nDisallow: /private/\n"))
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer ts.Close()
+
+	handler := RobotstxtMiddleware()(defaultMessageHandler())
+	u, _ := url.Parse(ts.URL)
+	delayer := handler.(crawlDelayer)
+	if d := delayer.CrawlDelay(u, ""); d != 0 {
+		t.Errorf("CrawlDelay() expected 0 before robots.txt fetched; got %v", d)
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	if _, err := handler.Send(req); err != nil {
+		t.Fatal(err)
+	}
+	var delayTests = []struct {
+		ua    string
+		delay time.Duration
+	}{
+		{"antch", 2 * time.Second},
+		{"SlowBot/1.0", 10 * time.Second},
+		// The group of fastbot has no delay, the "*" is not used.
+		{"fastbot", 0},
+	}
+	for _, test := range delayTests {
+		if g, e := delayer.CrawlDelay(u, test.ua), test.delay; g != e {
+			t.Errorf("CrawlDelay(%s) expected %v; got %v", test.ua, e, g)
+		}
+	}
+
+	tc := &Crawler{RobotstxtMaxDelay: 5 * time.Second, msgHandlers: []HttpMessageHandler{handler}}
+	req.Header.Set("User-Agent", "slowbot")
+	if g, e := tc.crawlDelay(req), 5*time.Second; g != e {
+		t.Errorf("crawlDelay() expected %v; got %v", e, g)
+	}
+}
+
+func TestParseRequestRate(t *testing.T) {
+	var rateTests = []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{"1/5", 5 * time.Second, true},
+		{"1/10s", 10 * time.Second, true},
+		{"30/1m", 2 * time.Second, true},
+		{"1/5 0600-0845", 5 * time.Second, true},
+		{"0/5", 0, false},
+		{"fast", 0, false},
+	}
+	for _, test := range rateTests {
+		d, ok := parseRequestRate(test.value)
+		if d != test.delay || ok != test.ok {
+			t.Errorf("parseRequestRate(%q) = %v, %v; want %v, %v", test.value, d, ok, test.delay, test.ok)
+		}
+	}
+}
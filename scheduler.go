@@ -0,0 +1,212 @@
+package antch
+
+import (
+	"container/heap"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// ErrSchedulerClosed is returned by the Scheduler's Push and Pop
+// methods after a call to Close.
+var ErrSchedulerClosed = errors.New("scheduler: closed")
+
+// Scheduler is an interface for the queue of HTTP requests that
+// waiting to be crawled by Crawler.
+//
+// The Handlers are blocked on writing follow-up requests while the
+// Scheduler holds Crawler.MaxQueuedRequests requests. A Scheduler may
+// also return an error from Push to reject the requests if it is full,
+// they are logged and dropped.
+type Scheduler interface {
+	// Push puts an HTTP request into the queue.
+	Push(*http.Request) error
+
+	// Pop removes and returns the next HTTP request from the queue.
+	// Pop blocks until a request is available or Scheduler is closed.
+	Pop() (*http.Request, error)
+
+	// Len returns the number of requests in the queue.
+	Len() int
+
+	// Close closes the queue, any blocked Pop operations will be
+	// unblocked and return ErrSchedulerClosed.
+	Close() error
+}
+
+// Acker is an optional interface implemented by the Scheduler that
+// needs to know when the popped requests are finished. The Crawler
+// calls Ack after the Handler of the request has returned or the
+// request has failed.
+type Acker interface {
+	// Ack marks the request popped from the queue as finished.
+	Ack(*http.Request) error
+}
+
+type queueItem struct {
+	req      *http.Request
+	priority int
+	seq      uint64
+
+	// rec is the journal record of the request if the queue is
+	// backed by a disk file, and err is the error of writing
+	// the take record of it.
+	rec *journalRecord
+	err error
+}
+
+// requestHeap implements heap.Interface, the requests with higher
+// priority are popped first, and FIFO for the same priority.
+type requestHeap []*queueItem
+
+func (h requestHeap) Len() int { return len(h) }
+
+func (h requestHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h requestHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *requestHeap) Push(x interface{}) {
+	*h = append(*h, x.(*queueItem))
+}
+
+func (h *requestHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+type priorityQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  requestHeap
+	seq    uint64
+	closed bool
+
+	// journal is not nil if the queue is backed by a disk file.
+	journal *journal
+	// inflight is the popped requests that have not been acked,
+	// they are kept in the journal until acked.
+	inflight map[*http.Request]*queueItem
+}
+
+func (q *priorityQueue) Push(req *http.Request) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrSchedulerClosed
+	}
+	item := &queueItem{req: req, priority: Priority(req), seq: q.seq + 1}
+	old, ok := q.inflight[req]
+	if q.journal != nil {
+		var err error
+		if ok {
+			// The popped request is put back, its body may
+			// have been read, the record is reused.
+			err = q.journal.repush(item, old.rec)
+		} else {
+			err = q.journal.push(item)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	q.seq++
+	heap.Push(&q.items, item)
+	q.cond.Signal()
+	// The old record of the request put back is acked. It will be
+	// crawled again after restart at worst if failed.
+	if ok {
+		delete(q.inflight, req)
+		q.ack(old)
+	}
+	return nil
+}
+
+func (q *priorityQueue) Pop() (*http.Request, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, ErrSchedulerClosed
+	}
+	item := heap.Pop(&q.items).(*queueItem)
+	if q.journal != nil {
+		// The request is still returned if it failed to record,
+		// the error is returned by Ack.
+		item.err = q.journal.take(item)
+		q.inflight[item.req] = item
+	}
+	return item.req, nil
+}
+
+func (q *priorityQueue) Ack(req *http.Request) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.inflight[req]
+	if !ok {
+		return nil
+	}
+	delete(q.inflight, req)
+	if q.closed {
+		// The request will be crawled again after restart.
+		return nil
+	}
+	if err := q.ack(item); err != nil {
+		return err
+	}
+	return item.err
+}
+
+func (q *priorityQueue) ack(item *queueItem) error {
+	if err := q.journal.pop(item); err != nil {
+		return err
+	}
+	if n := len(q.items) + len(q.inflight); q.journal.garbage >= compactSize && q.journal.garbage > n {
+		return q.journal.compact(q.items, q.inflight)
+	}
+	return nil
+}
+
+func (q *priorityQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+func (q *priorityQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.cond.Broadcast()
+	if q.journal != nil {
+		return q.journal.Close()
+	}
+	return nil
+}
+
+// NewPriorityQueue returns a new in-memory Scheduler that pops
+// the requests with higher priority first. Requests with the
+// same priority are popped in the order they were pushed.
+// The queue is unbounded, use Crawler.MaxQueuedRequests to limit it.
+func NewPriorityQueue() Scheduler {
+	q := &priorityQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
@@ -0,0 +1,129 @@
+package antch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	var pushTests = []struct {
+		url      string
+		priority int
+	}{
+		{"http://example.com/list/1", 0},
+		{"http://example.com/item/1", 10},
+		{"http://example.com/list/2", 0},
+		{"http://example.com/robots.txt", -1},
+		{"http://example.com/item/2", 10},
+	}
+	want := []string{
+		"http://example.com/item/1",
+		"http://example.com/item/2",
+		"http://example.com/list/1",
+		"http://example.com/list/2",
+		"http://example.com/robots.txt",
+	}
+
+	q := NewPriorityQueue()
+	for _, test := range pushTests {
+		req, _ := http.NewRequest("GET", test.url, nil)
+		if err := q.Push(WithPriority(req, test.priority)); err != nil {
+			t.Fatalf("Push failed: %v", err)
+		}
+	}
+	if g, e := q.Len(), len(pushTests); g != e {
+		t.Errorf("Len() expected %d; got %d", e, g)
+	}
+	for _, e := range want {
+		req, err := q.Pop()
+		if err != nil {
+			t.Fatalf("Pop failed: %v", err)
+		}
+		if g := req.URL.String(); g != e {
+			t.Errorf("expected %s; got %s", e, g)
+		}
+	}
+}
+
+func TestPriorityQueueClose(t *testing.T) {
+	q := NewPriorityQueue()
+	done := make(chan error)
+	go func() {
+		_, err := q.Pop()
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+
+	select {
+	case err := <-done:
+		if err != ErrSchedulerClosed {
+			t.Errorf("Pop() err = %v; want %v", err, ErrSchedulerClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pop() was not unblocked by Close")
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if err := q.Push(req); err != ErrSchedulerClosed {
+		t.Errorf("Push() err = %v; want %v", err, ErrSchedulerClosed)
+	}
+}
+
+// lenScheduler records the maximum length of the queue.
+type lenScheduler struct {
+	Scheduler
+	mu  sync.Mutex
+	max int
+}
+
+func (s *lenScheduler) Push(req *http.Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.Scheduler.Push(req); err != nil {
+		return err
+	}
+	if n := s.Scheduler.Len(); n > s.max {
+		s.max = n
+	}
+	return nil
+}
+
+func TestCrawlerMaxQueuedRequests(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	s := &lenScheduler{Scheduler: NewPriorityQueue()}
+	tc := NewCrawler()
+	tc.Scheduler = s
+	tc.MaxQueuedRequests = 2
+	tc.DownloadDelay = time.Millisecond
+	var n int32
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		atomic.AddInt32(&n, 1)
+		if resp.Request.URL.Path != "/" {
+			return
+		}
+		for i := 0; i < 10; i++ {
+			req, _ := http.NewRequest("GET", fmt.Sprintf("%s/%d", ts.URL, i), nil)
+			c <- req
+		}
+	}))
+	tc.StartURLs([]string{ts.URL + "/"})
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if g, e := atomic.LoadInt32(&n), int32(11); g != e {
+		t.Errorf("expected %d responses; got %d", e, g)
+	}
+	if s.max > tc.MaxQueuedRequests {
+		t.Errorf("expected at most %d queued requests; got %d", tc.MaxQueuedRequests, s.max)
+	}
+}
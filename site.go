@@ -0,0 +1,78 @@
+package antch
+
+import (
+	"strings"
+	"time"
+)
+
+// SiteSettings specifies the settings for crawling a website that
+// override the Crawler's settings. A zero value field means uses
+// the Crawler's setting.
+type SiteSettings struct {
+	// MaxConcurrentRequests specifies the maximum number of concurrent
+	// requests that will be performed to the website.
+	MaxConcurrentRequests int
+
+	// DownloadDelay specifies delay time to wait before access the
+	// website. A negative value means no delay.
+	DownloadDelay time.Duration
+
+	// RequestTimeout specifies a time to wait before the HTTP Request
+	// to the website times out.
+	RequestTimeout time.Duration
+}
+
+// matchSite reports whether the host matches the pattern. The pattern
+// is a host name such as "example.com", or a wildcard such as
+// "*.example.com" that matches example.com and all its subdomains.
+func matchSite(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return host == pattern[2:] || strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// siteSettings returns the settings for the given host, the
+// exact host pattern takes precedence over wildcard patterns,
+// and the longer wildcard pattern takes precedence.
+func (c *Crawler) siteSettings(host string) SiteSettings {
+	s := SiteSettings{
+		MaxConcurrentRequests: c.maxConcurrentRequestsPerSite(),
+		DownloadDelay:         c.downloadDelay(),
+		RequestTimeout:        c.requestTimeout(),
+	}
+
+	var (
+		v       SiteSettings
+		pattern string
+	)
+	for k, e := range c.Sites {
+		if !matchSite(k, host) {
+			continue
+		}
+		if k == host {
+			v, pattern = e, k
+			break
+		}
+		if len(k) > len(pattern) {
+			v, pattern = e, k
+		}
+	}
+	if pattern == "" {
+		return s
+	}
+
+	if v.MaxConcurrentRequests > 0 {
+		s.MaxConcurrentRequests = v.MaxConcurrentRequests
+	}
+	switch {
+	case v.DownloadDelay < 0:
+		s.DownloadDelay = 0
+	case v.DownloadDelay > 0:
+		s.DownloadDelay = v.DownloadDelay
+	}
+	if v.RequestTimeout > 0 {
+		s.RequestTimeout = v.RequestTimeout
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package antch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSiteSettings(t *testing.T) {
+	tc := &Crawler{
+		DownloadDelay: time.Second,
+		Sites: map[string]SiteSettings{
+			"*.example.com":     {MaxConcurrentRequests: 2},
+			"*.api.example.com": {MaxConcurrentRequests: 4, DownloadDelay: -1},
+			"www.example.com":   {RequestTimeout: time.Minute},
+		},
+	}
+	var siteTests = []struct {
+		host        string
+		concurrency int
+		delay       time.Duration
+		timeout     time.Duration
+	}{
+		{"example.org", 1, time.Second, 30 * time.Second},
+		{"example.com", 2, time.Second, 30 * time.Second},
+		{"img.example.com", 2, time.Second, 30 * time.Second},
+		{"v1.api.example.com", 4, 0, 30 * time.Second},
+		{"www.example.com", 1, time.Second, time.Minute},
+		{"badexample.com", 1, time.Second, 30 * time.Second},
+	}
+	for _, test := range siteTests {
+		s := tc.siteSettings(test.host)
+		if s.MaxConcurrentRequests != test.concurrency || s.DownloadDelay != test.delay || s.RequestTimeout != test.timeout {
+			t.Errorf("siteSettings(%s) = %+v; want {%d %v %v}", test.host, s, test.concurrency, test.delay, test.timeout)
+		}
+	}
+}
+
+func TestSiteSettingsConcurrency(t *testing.T) {
+	var (
+		mu           sync.Mutex
+		active, peak int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	tc := NewCrawler()
+	tc.Sites = map[string]SiteSettings{
+		"127.0.0.1": {MaxConcurrentRequests: 3, DownloadDelay: -1},
+	}
+	for i := 0; i < 9; i++ {
+		tc.EnqueueURL(fmt.Sprintf("%s/%d", ts.URL, i))
+	}
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if g, e := peak, 3; g != e {
+		t.Errorf("expected %d concurrent requests; got %d", e, g)
+	}
+}
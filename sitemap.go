@@ -0,0 +1,184 @@
+package antch
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+	"github.com/temoto/robotstxt"
+)
+
+// SitemapRule maps the URLs in sitemaps that matches Pattern
+// to the Handler.
+type SitemapRule struct {
+	// Pattern is a regular expression that matches the URL.
+	Pattern *regexp.Regexp
+
+	// Handler specifies a Handler to serve the response of the URL.
+	// If nil, the response is served by the Handler registered for
+	// the URL.
+	Handler Handler
+}
+
+// SitemapSpider is a Handler that discovers URLs from sitemaps, and
+// crawls the URLs. The response can be a robots.txt that the sitemaps
+// are followed by its Sitemap directives, a sitemap index file that
+// the sitemaps in it are followed, or a sitemap file. The gzipped
+// sitemap files are supported.
+//
+// Use Crawler.StartSitemaps to start crawling from robots.txt or
+// sitemap URLs.
+type SitemapSpider struct {
+	// Rules specifies the rules to map the URLs in sitemaps to
+	// Handlers, the first matched rule is used and the URLs that
+	// not matches any rules are ignored.
+	// If empty, all URLs are crawled and served by the Handlers
+	// registered for them.
+	Rules []SitemapRule
+
+	// Follow specifies regular expressions of the sitemap URLs in
+	// sitemap index files should be followed.
+	// If empty, all sitemaps are followed.
+	Follow []*regexp.Regexp
+
+	// ModifiedSince specifies only the URLs and sitemaps that modified
+	// after it are crawled, based on their lastmod. The URLs without
+	// lastmod are always crawled.
+	// If zero, all URLs are crawled.
+	ModifiedSince time.Time
+}
+
+var lastmodLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+}
+
+// parseLastmod parses the lastmod value of sitemaps, it's in
+// W3C Datetime format.
+func parseLastmod(v string) (time.Time, bool) {
+	v = strings.TrimSpace(v)
+	for _, layout := range lastmodLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (s *SitemapSpider) modified(lastmod string) bool {
+	if s.ModifiedSince.IsZero() {
+		return true
+	}
+	t, ok := parseLastmod(lastmod)
+	return !ok || t.After(s.ModifiedSince)
+}
+
+func (s *SitemapSpider) follow(URL string) bool {
+	if len(s.Follow) == 0 {
+		return true
+	}
+	for _, re := range s.Follow {
+		if re.MatchString(URL) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SitemapSpider) rule(URL string) (Handler, bool) {
+	if len(s.Rules) == 0 {
+		return nil, true
+	}
+	for _, r := range s.Rules {
+		if r.Pattern.MatchString(URL) {
+			return r.Handler, true
+		}
+	}
+	return nil, false
+}
+
+// ServeSpider performs extract sitemaps and URLs from the response.
+func (s *SitemapSpider) ServeSpider(c chan<- Item, resp *http.Response) {
+	if strings.HasSuffix(resp.Request.URL.Path, "/robots.txt") {
+		data, err := robotstxt.FromResponse(resp)
+		if err != nil {
+			return
+		}
+		for _, URL := range data.Sitemaps {
+			s.crawl(c, URL, s)
+		}
+		return
+	}
+
+	r, err := sitemapReader(resp.Body)
+	if err != nil {
+		return
+	}
+	doc, err := xmlquery.Parse(r)
+	if err != nil {
+		return
+	}
+	for _, n := range xmlquery.Find(doc, "//sitemapindex/sitemap") {
+		URL := sitemapText(n, "loc")
+		if URL != "" && s.follow(URL) && s.modified(sitemapText(n, "lastmod")) {
+			s.crawl(c, URL, s)
+		}
+	}
+	for _, n := range xmlquery.Find(doc, "//urlset/url") {
+		URL := sitemapText(n, "loc")
+		if URL == "" || !s.modified(sitemapText(n, "lastmod")) {
+			continue
+		}
+		if h, ok := s.rule(URL); ok {
+			s.crawl(c, URL, h)
+		}
+	}
+}
+
+func (s *SitemapSpider) crawl(c chan<- Item, URL string, h Handler) {
+	req, err := http.NewRequest("GET", URL, nil)
+	if err != nil {
+		return
+	}
+	if h != nil {
+		req = WithHandler(req, h)
+	}
+	c <- req
+}
+
+func sitemapText(n *xmlquery.Node, name string) string {
+	if e := n.SelectElement(name); e != nil {
+		return strings.TrimSpace(e.InnerText())
+	}
+	return ""
+}
+
+// sitemapReader returns a reader that decompresses the gzipped sitemap
+// file, the gzipped file is detected by its magic number.
+func sitemapReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(2); err == nil && b[0] == 0x1f && b[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// StartSitemaps starts crawling for the given robots.txt or sitemap
+// URL list, the responses are served by the SitemapSpider s.
+func (c *Crawler) StartSitemaps(URLs []string, s *SitemapSpider) {
+	c.once.Do(c.init)
+	for _, URL := range URLs {
+		req, err := http.NewRequest("GET", URL, nil)
+		if err != nil {
+			c.logf("crawler: invalid sitemap URL %s: %v", URL, err)
+			continue
+		}
+		c.Crawl(WithHandler(req, s))
+	}
+}
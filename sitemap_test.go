@@ -0,0 +1,102 @@
+package antch
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSitemapSpider(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprintf(w, "User-agent: *\nSitemap: %s/sitemap_index.xml\n", ts.URL)
+		case "/sitemap_index.xml":
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<sitemap><loc>%[1]s/sitemap_new.xml.gz</loc><lastmod>2017-10-01</lastmod></sitemap>
+	<sitemap><loc>%[1]s/sitemap_old.xml</loc><lastmod>2016-01-01T00:00:00+00:00</lastmod></sitemap>
+</sitemapindex>`, ts.URL)
+		case "/sitemap_new.xml.gz":
+			w.Header().Set("Content-Type", "application/x-gzip")
+			zw := gzip.NewWriter(w)
+			defer zw.Close()
+			fmt.Fprintf(zw, `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc>%[1]s/product/1</loc><lastmod>2017-10-01</lastmod></url>
+	<url><loc>%[1]s/product/2</loc></url>
+	<url><loc>%[1]s/product/3</loc><lastmod>2016-06-01</lastmod></url>
+	<url><loc>%[1]s/about</loc></url>
+	<url><loc>%[1]s/news/1</loc></url>
+</urlset>`, ts.URL)
+		case "/sitemap_old.xml":
+			t.Errorf("the old sitemap should not be followed")
+		default:
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+	defer ts.Close()
+
+	var (
+		mu    sync.Mutex
+		items []string
+	)
+	newHandler := func(name string) Handler {
+		return HandlerFunc(func(c chan<- Item, resp *http.Response) {
+			c <- name + ":" + resp.Request.URL.Path
+		})
+	}
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.Handle("*", newHandler("default"))
+	tc.UsePipeline(func(_ PipelineHandler) PipelineHandler {
+		return PipelineHandlerFunc(func(v Item) {
+			mu.Lock()
+			items = append(items, v.(string))
+			mu.Unlock()
+		})
+	})
+
+	tc.StartSitemaps([]string{ts.URL + "/robots.txt"}, &SitemapSpider{
+		Rules: []SitemapRule{
+			{Pattern: regexp.MustCompile("/product/"), Handler: newHandler("product")},
+			{Pattern: regexp.MustCompile("/news/")},
+		},
+		ModifiedSince: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+	})
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	want := []string{"default:/news/1", "product:/product/1", "product:/product/2"}
+	sort.Strings(items)
+	if g, e := fmt.Sprint(items), fmt.Sprint(want); g != e {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestParseLastmod(t *testing.T) {
+	var lastmodTests = []struct {
+		value string
+		ok    bool
+	}{
+		{"2017-10-01", true},
+		{"2017-10-01T18:30Z", true},
+		{"2017-10-01T18:30+08:00", true},
+		{"2017-10-01T18:30:15.5+08:00", true},
+		{"yesterday", false},
+	}
+	for _, test := range lastmodTests {
+		if _, ok := parseLastmod(test.value); ok != test.ok {
+			t.Errorf("parseLastmod(%q) ok = %v; want %v", test.value, ok, test.ok)
+		}
+	}
+}
@@ -9,7 +9,11 @@ import (
 // Handler is the HTTP Response handler interface that defines
 // how to extract scraped items from their pages.
 //
-// ServeSpider should be write got Item to the Channel.
+// ServeSpider should be write got Item to the Channel. An *http.Request
+// written to the Channel is not an Item, it will be crawled as a follow-up
+// request, use WithHandler to attach a Handler for its response.
+//
+// The Channel may not be used after the ServeSpider method has returned.
 type Handler interface {
 	ServeSpider(chan<- Item, *http.Response)
 }
@@ -24,6 +28,28 @@ func (f HandlerFunc) ServeSpider(c chan<- Item, resp *http.Response) {
 	f(c, resp)
 }
 
+// ErrorHandler is the handler interface for the HTTP requests that
+// failed, such as network errors, timeouts or the requests denied by
+// middlewares.
+//
+// ServeError receives the failed request and its error, it can write
+// Items to the Channel like a Handler, such as an item that records
+// the failure, or an *http.Request to crawl again.
+//
+// The Channel may not be used after the ServeError method has returned.
+type ErrorHandler interface {
+	ServeError(chan<- Item, *http.Request, error)
+}
+
+// ErrorHandlerFunc is an adapter to allow the use of ordinary
+// functions as ErrorHandler.
+type ErrorHandlerFunc func(chan<- Item, *http.Request, error)
+
+// ServeError calls f(c, req, err).
+func (f ErrorHandlerFunc) ServeError(c chan<- Item, req *http.Request, err error) {
+	f(c, req, err)
+}
+
 // VoidHandler returns a Handler that without doing anything.
 func VoidHandler() Handler {
 	return HandlerFunc(func(_ chan<- Item, resp *http.Response) {
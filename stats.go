@@ -0,0 +1,203 @@
+package antch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Stats is the interface of a stats collector that collects the
+// values of a crawl, such as the number of requests and responses.
+// The values are kept for each website by its host name, and the
+// global values are kept by the site "".
+//
+// The Crawler and the built-in middlewares report the values below,
+// to the global and the site of the request:
+//
+//	requests/scheduled           the requests put into the Scheduler
+//	requests/sent                the requests sent to websites
+//	requests/failed              the requests failed with errors
+//	requests/failed/timeout      the requests timed out
+//	requests/failed/proxy        the requests failed via the proxy
+//	requests/filtered/offsite    the requests dropped by AllowedDomains
+//	requests/filtered/depth      the requests dropped by MaxDepth
+//	requests/filtered/duplicate  the requests denied by dupe filters
+//	requests/filtered/robots     the requests denied by robots.txt
+//	requests/depth/<n>           the requests of depth n put into the Scheduler
+//	requests/depth/max           the maximum depth of requests, global only
+//
+//	responses                    the responses received
+//	responses/status/<code>      the responses of the HTTP status code
+//	responses/bytes              the bytes of the response bodies read
+//
+//	retries                      the requests retried by RetryMiddleware
+//	retries/max_reached          the requests failed after max retries
+//
+//	httpcache/hit                the requests served from HttpCacheMiddleware
+//	httpcache/miss               the requests not served from the cache
+//	httpcache/revalidate         the stale cached responses revalidated
+//	httpcache/store              the responses stored into the cache
+//
+//	incremental/not_modified     the pages not modified since the last crawl
+//	incremental/store_errors     the Validators failed to write into the store
+//
+//	items                        the items written into the pipeline
+//	handlers/panics              the Handlers got panic
+type Stats interface {
+	// Inc increments the value of key of the site by delta.
+	Inc(site, key string, delta int64)
+
+	// Set sets the value of key of the site.
+	Set(site, key string, value int64)
+
+	// Max sets the value of key of the site to value if it is larger
+	// than the current value.
+	Max(site, key string, value int64)
+
+	// Snapshot returns a copy of all values, the first key is the
+	// site. It returns nil if the values are not available, such as
+	// they are sent to a remote server.
+	Snapshot() map[string]map[string]int64
+}
+
+type memoryStats struct {
+	mu sync.Mutex
+	m  map[string]map[string]int64
+}
+
+// NewMemoryStats returns a new Stats that keeps the values in memory.
+func NewMemoryStats() Stats {
+	return &memoryStats{m: make(map[string]map[string]int64)}
+}
+
+func (s *memoryStats) values(site string) map[string]int64 {
+	m := s.m[site]
+	if m == nil {
+		m = make(map[string]int64)
+		s.m[site] = m
+	}
+	return m
+}
+
+func (s *memoryStats) Inc(site, key string, delta int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values(site)[key] += delta
+}
+
+func (s *memoryStats) Set(site, key string, value int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values(site)[key] = value
+}
+
+func (s *memoryStats) Max(site, key string, value int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.values(site)
+	if v, ok := m[key]; !ok || value > v {
+		m[key] = value
+	}
+}
+
+func (s *memoryStats) Snapshot() map[string]map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]map[string]int64, len(s.m))
+	for site, values := range s.m {
+		v := make(map[string]int64, len(values))
+		for key, n := range values {
+			v[key] = n
+		}
+		m[site] = v
+	}
+	return m
+}
+
+type statsKey struct{}
+
+// IncStat increments the value of key by delta for the global and
+// the site of req, in the Stats of the Crawler that sending req. It is
+// used by middlewares to report their values, see Stats.
+func IncStat(req *http.Request, key string, delta int64) {
+	if s, ok := req.Context().Value(statsKey{}).(Stats); ok {
+		incStat(s, req, key, delta)
+	}
+}
+
+func incStat(s Stats, req *http.Request, key string, delta int64) {
+	s.Inc("", key, delta)
+	if req != nil && req.URL != nil {
+		if site := req.URL.Hostname(); site != "" {
+			s.Inc(site, key, delta)
+		}
+	}
+}
+
+// Stats returns a copy of the values of the StatsCollector, the first
+// key is the site, and the global values are kept by the site "".
+func (c *Crawler) Stats() map[string]map[string]int64 {
+	c.once.Do(c.init)
+	return c.stats.Snapshot()
+}
+
+func (c *Crawler) incStat(req *http.Request, key string, delta int64) {
+	incStat(c.stats, req, key, delta)
+}
+
+// failedStat returns the stats key of the error of a failed request.
+func failedStat(err error) string {
+	var perr *ProxyError
+	switch {
+	case errors.Is(err, ErrDuplicate):
+		return "requests/filtered/duplicate"
+	case errors.Is(err, ErrRobotsDenied):
+		return "requests/filtered/robots"
+	case errors.Is(err, ErrOffsite):
+		return "requests/filtered/offsite"
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return "requests/failed/timeout"
+	case errors.As(err, &perr):
+		return "requests/failed/proxy"
+	}
+	return ""
+}
+
+// dumpStats logs the global values of the stats.
+func (c *Crawler) dumpStats() {
+	values := c.stats.Snapshot()[""]
+	if len(values) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("crawler: dumping stats:")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\n\t%s: %d", k, values[k])
+	}
+	c.logf("%s", b.String())
+}
+
+// statsBody counts the bytes read from the response body.
+type statsBody struct {
+	io.ReadCloser
+	c   *Crawler
+	req *http.Request
+}
+
+func (b *statsBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.c.incStat(b.req, "responses/bytes", int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,105 @@
+package antch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryStats(t *testing.T) {
+	s := NewMemoryStats()
+	s.Inc("", "requests", 1)
+	s.Inc("", "requests", 2)
+	s.Inc("example.com", "requests", 1)
+	s.Set("", "spiders", 5)
+	s.Set("", "spiders", 3)
+	s.Max("", "depth", 2)
+	s.Max("", "depth", 1)
+
+	m := s.Snapshot()
+	if g, e := fmt.Sprint(m), "map[:map[depth:2 requests:3 spiders:3] example.com:map[requests:1]]"; g != e {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	// The snapshot is a copy.
+	m[""]["requests"] = 0
+	if g, e := s.Snapshot()[""]["requests"], int64(3); g != e {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+}
+
+func TestCrawlerStats(t *testing.T) {
+	var n int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+		case "/":
+			w.Write([]byte("hello"))
+		case "/retry":
+			if atomic.AddInt32(&n, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	tc := NewCrawler()
+	tc.DownloadDelay = time.Millisecond
+	tc.MaxDepth = 1
+	tc.AllowedDomains = []string{u.Hostname()}
+	tc.UseRobotstxt()
+	tc.UseMiddleware(RetryMiddleware(RetryPolicy{BaseDelay: time.Millisecond}))
+	tc.Handle("*", HandlerFunc(func(c chan<- Item, resp *http.Response) {
+		ioutil.ReadAll(resp.Body)
+		c <- resp.Request.URL.Path
+		if resp.Request.URL.Path == "/" {
+			for _, URL := range []string{ts.URL + "/private", ts.URL + "/missing", "http://example.org/"} {
+				req, _ := http.NewRequest("GET", URL, nil)
+				c <- req
+			}
+		}
+		if resp.Request.URL.Path == "/missing" {
+			req, _ := http.NewRequest("GET", ts.URL+"/deeper", nil)
+			c <- req
+		}
+	}))
+	tc.StartURLs([]string{ts.URL + "/", ts.URL + "/retry"})
+	if err := tc.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	stats := tc.Stats()
+	for _, site := range []string{"", u.Hostname()} {
+		for key, want := range map[string]int64{
+			"requests/scheduled":       4,
+			"requests/sent":            4,
+			"requests/filtered/robots": 1,
+			"requests/filtered/depth":  1,
+			"responses":                3,
+			"responses/status/200":     2,
+			"responses/status/404":     1,
+			"responses/bytes":          int64(len("hello") + len("404 page not found\n")),
+			"retries":                  1,
+			"items":                    3,
+		} {
+			if g := stats[site][key]; g != want {
+				t.Errorf("%q %s expected %d; got %d", site, key, want, g)
+			}
+		}
+	}
+	if g, e := stats[""]["requests/filtered/offsite"], int64(1); g != e {
+		t.Errorf("requests/filtered/offsite expected %d; got %d", e, g)
+	}
+	if g, e := stats[""]["requests/depth/max"], int64(1); g != e {
+		t.Errorf("requests/depth/max expected %d; got %d", e, g)
+	}
+}
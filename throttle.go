@@ -0,0 +1,116 @@
+package antch
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// throttle adjusts the download delay and concurrency of a website
+// based on the latency and errors of the responses.
+type throttle struct {
+	minDelay       time.Duration
+	maxDelay       time.Duration
+	target         float64
+	maxConcurrency int
+
+	delay       time.Duration
+	concurrency int
+	// successes is the number of successful responses since
+	// the concurrency was changed.
+	successes int
+}
+
+func newThrottle(minDelay, maxDelay time.Duration, target float64, maxConcurrency int) *throttle {
+	t := &throttle{
+		minDelay:       minDelay,
+		maxDelay:       maxDelay,
+		target:         target,
+		maxConcurrency: maxConcurrency,
+		delay:          minDelay,
+		concurrency:    int(math.Ceil(target)),
+	}
+	if t.concurrency > maxConcurrency {
+		t.concurrency = maxConcurrency
+	}
+	if t.concurrency < 1 {
+		t.concurrency = 1
+	}
+	return t
+}
+
+func (t *throttle) setDelay(d time.Duration) {
+	if d < t.minDelay {
+		d = t.minDelay
+	}
+	if d > t.maxDelay {
+		d = t.maxDelay
+	}
+	t.delay = d
+}
+
+// overloaded reports whether the response or error of a request shows
+// the website is overloaded. The requests that were filtered, cancelled
+// or failed on the proxy are not counted.
+func overloaded(resp *http.Response, err error) bool {
+	if err != nil {
+		if v, ok := err.(*url.Error); ok {
+			err = v.Err
+		}
+		if errors.Is(err, context.Canceled) {
+			return false
+		}
+		// The proxy is failed, not the website.
+		var proxyErr *ProxyError
+		if errors.As(err, &proxyErr) {
+			return false
+		}
+		var netErr net.Error
+		return errors.As(err, &netErr)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// update adjusts the delay and concurrency after got a response.
+func (t *throttle) update(latency time.Duration, resp *http.Response, err error) {
+	if overloaded(resp, err) {
+		// The website is overloaded, halves the concurrency
+		// and doubles the delay.
+		t.successes = 0
+		if t.concurrency > 1 {
+			t.concurrency /= 2
+		}
+		d := t.delay * 2
+		if d < latency {
+			d = latency
+		}
+		t.setDelay(d)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	// The delay that makes target concurrency requests in flight.
+	target := time.Duration(float64(latency) / t.target)
+	d := (t.delay + target) / 2
+	if d < target {
+		d = target
+	}
+	// Don't reduce the delay for the non-200 responses, the error
+	// pages and redirections are usually small and fast.
+	if resp.StatusCode != http.StatusOK && d < t.delay {
+		d = t.delay
+	}
+	t.setDelay(d)
+
+	t.successes++
+	if t.successes >= t.concurrency && t.concurrency < t.maxConcurrency {
+		t.concurrency++
+		t.successes = 0
+	}
+}
@@ -0,0 +1,85 @@
+package antch
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestThrottleLatency(t *testing.T) {
+	tt := newThrottle(100*time.Millisecond, 10*time.Second, 1.0, 1)
+	ok := &http.Response{StatusCode: http.StatusOK}
+
+	// The slow website.
+	for i := 0; i < 10; i++ {
+		tt.update(2*time.Second, ok, nil)
+	}
+	if tt.delay < 2*time.Second {
+		t.Errorf("expected delay >= 2s for slow website; got %v", tt.delay)
+	}
+	// The website becomes fast.
+	for i := 0; i < 10; i++ {
+		tt.update(time.Millisecond, ok, nil)
+	}
+	if g, e := tt.delay, 100*time.Millisecond; g != e {
+		t.Errorf("expected delay %v for fast website; got %v", e, g)
+	}
+	// Never above the max delay.
+	tt.update(time.Minute, ok, nil)
+	if g, e := tt.delay, 10*time.Second; g != e {
+		t.Errorf("expected delay %v; got %v", e, g)
+	}
+}
+
+func TestThrottleConcurrency(t *testing.T) {
+	tt := newThrottle(0, time.Second, 1.0, 4)
+	ok := &http.Response{StatusCode: http.StatusOK}
+	if g, e := tt.concurrency, 1; g != e {
+		t.Fatalf("expected initial concurrency %d; got %d", e, g)
+	}
+	for i := 0; i < 20; i++ {
+		tt.update(time.Millisecond, ok, nil)
+	}
+	if g, e := tt.concurrency, 4; g != e {
+		t.Errorf("expected concurrency %d after successes; got %d", e, g)
+	}
+
+	tt.update(time.Millisecond, &http.Response{StatusCode: http.StatusServiceUnavailable}, nil)
+	if g, e := tt.concurrency, 2; g != e {
+		t.Errorf("expected concurrency %d after error; got %d", e, g)
+	}
+	delay := tt.delay
+	tt.update(10*time.Millisecond, nil, &url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}})
+	if g, e := tt.concurrency, 1; g != e {
+		t.Errorf("expected concurrency %d after error; got %d", e, g)
+	}
+	if tt.delay <= delay {
+		t.Errorf("expected delay > %v after error; got %v", delay, tt.delay)
+	}
+
+	// The requests that were filtered or cancelled are not counted.
+	for i := 0; i < 4; i++ {
+		tt.update(time.Millisecond, ok, nil)
+	}
+	concurrency, delay := tt.concurrency, tt.delay
+	for _, err := range []error{
+		&url.Error{Op: "Get", Err: ErrRobotsDenied},
+		&url.Error{Op: "Get", Err: ErrDuplicate},
+		&url.Error{Op: "Get", Err: ErrOffsite},
+		&url.Error{Op: "Get", Err: &ProxyError{Err: errors.New("no proxy")}},
+		&url.Error{Op: "Get", Err: &ProxyError{
+			URL: &url.URL{Scheme: "http", Host: "127.0.0.1:8080"},
+			Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")},
+		}},
+		&url.Error{Op: "Get", Err: context.Canceled},
+	} {
+		tt.update(time.Millisecond, nil, err)
+		if tt.concurrency != concurrency || tt.delay != delay {
+			t.Errorf("%v: expected concurrency %d and delay %v; got %d and %v", err, concurrency, delay, tt.concurrency, tt.delay)
+		}
+	}
+}